@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"log/syslog"
 	"net/http"
@@ -12,7 +13,10 @@ import (
 
 	"tsuribari/internal/config"
 	"tsuribari/internal/handlers"
+	"tsuribari/internal/ipsource"
 	"tsuribari/internal/middleware"
+	"tsuribari/internal/outbox"
+	"tsuribari/internal/providers"
 	"tsuribari/internal/queue"
 	"tsuribari/internal/storage"
 )
@@ -67,6 +71,11 @@ func setupLogging() {
 }
 
 func main() {
+	// Client mode, for git hooks
+	if len(os.Args) > 1 && os.Args[1] == "notify" {
+		os.Exit(notify(os.Args[2:], os.Stdin, os.Stderr))
+	}
+
 	// Setup logging first
 	setupLogging()
 
@@ -92,28 +101,58 @@ func main() {
 	log.Printf("Connected to CouchDB: %s/%s", extractHostname(cfg.CouchDB.URL), cfg.CouchDB.Database)
 
 	// Initialize queue
-	rabbitMQ, err := queue.NewRabbitMQ(cfg.RabbitMQ.URL, cfg.RabbitMQ.Exchange, cfg.RabbitMQ.Queue)
+	rabbitMQ, err := queue.NewRabbitMQ(cfg.RabbitMQ)
 	if err != nil {
 		log.Fatal("Failed to connect to RabbitMQ:", err)
 	}
 	log.Printf("Connected to RabbitMQ: %s%s", extractHostname(cfg.RabbitMQ.URL), extractVhost(cfg.RabbitMQ.URL))
 	defer rabbitMQ.Close()
 
+	// Publish stored workflows, and retry those left pending
+	dispatcher := outbox.NewDispatcher(couchDB, rabbitMQ, cfg.Outbox)
+	go dispatcher.Run(context.Background())
+
+	// Initialize dynamic trusted IP sources
+	var ipSources []middleware.IPSource
+	for _, source := range cfg.Security.IPSources {
+		meta := ipsource.NewMeta(source)
+		if err := meta.LoadCache(); err != nil {
+			log.Printf("WARN: ip source %s: ignoring cache: %v", source.Name, err)
+		}
+		go meta.Run(context.Background())
+		ipSources = append(ipSources, meta)
+	}
+
+	// Initialize webhook providers
+	registry := providers.Default()
+	mappings, err := providers.NewMapping(cfg.Organisations)
+	if err != nil {
+		log.Fatal("Invalid mapping configuration:", err)
+	}
+	registry.Register(mappings)
+	if err := registry.Validate(cfg.Organisations); err != nil {
+		log.Fatal("Invalid provider configuration:", err)
+	}
+
 	// Initialize handlers
-	webhookHandler := handlers.NewWebhookHandler(couchDB, rabbitMQ)
+	webhookHandler := handlers.NewWebhookHandler(couchDB, dispatcher, registry, cfg.Organisations)
 
-	// Setup router
-	router := gin.Default()
+	// Setup router, keeping secrets passed as ?token= out of the logs
+	router := gin.New()
+	router.Use(middleware.Logger(), gin.Recovery())
 
-	// Health check
+	// Health check, reporting the RabbitMQ connection without failing on
+	// it, as webhooks are still accepted into the outbox meanwhile
 	router.GET("/healthz", func(c *gin.Context) {
-		c.Status(http.StatusOK)
+		c.JSON(http.StatusOK, gin.H{"rabbitmq": rabbitMQ.State()})
 	})
 
 	// Webhook endpoints with middleware
 	webhookGroup := router.Group("/webhooks")
-	webhookGroup.Use(middleware.IPFilter(cfg.Security.TrustedIPs))
-	webhookGroup.Use(middleware.HMACValidator(cfg.Security.Secrets))
+	webhookGroup.Use(middleware.IPFilter(cfg.Security.TrustedIPs, cfg.Security.TrustedProxies, ipSources...))
+	webhookGroup.Use(middleware.OrgIPFilter(cfg.Organisations))
+	webhookGroup.Use(middleware.HMACValidator(cfg.Organisations, registry))
+	webhookGroup.Use(middleware.ReplayGuard(cfg.Security.Replay))
 	{
 		webhookGroup.POST("/:organisation", webhookHandler.HandleWebhook)
 		webhookGroup.POST("/:organisation/:pipeline", webhookHandler.HandleWebhook)
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"tsuribari/internal/models"
+)
+
+// notifier signs and posts koan push payloads to a tsuribari endpoint.
+type notifier struct {
+	endpoint string
+	secret   string
+	client   *http.Client
+}
+
+// notify implements `tsuribari notify`, meant to be called from a git
+// post-receive hook. It reads "<old> <new> <ref>" lines from stdin and
+// posts one signed koan push per updated ref, with the message of its new
+// head and the options given to `git push -o`, if the repository accepts
+// them.
+func notify(args []string, stdin io.Reader, stderr io.Writer) int {
+	flags := flag.NewFlagSet("notify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	endpoint := flags.String("url", "", "webhook endpoint, e.g. https://ci.example/webhooks/demo")
+	repo := flags.String("repo", "", "clone URL of this repository")
+	org := flags.String("org", "", "organisation the repository belongs to")
+	secretFile := flags.String("secret-file", "", "file holding the shared secret (default $TSURIBARI_SECRET)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *endpoint == "" || *repo == "" || *org == "" {
+		fmt.Fprintln(stderr, "tsuribari notify: -url, -repo and -org are required")
+		return 2
+	}
+
+	secret, err := readSecret(*secretFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "tsuribari notify: %v\n", err)
+		return 1
+	}
+
+	pushes, err := readPushes(stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "tsuribari notify: %v\n", err)
+		return 1
+	}
+
+	n := &notifier{
+		endpoint: *endpoint,
+		secret:   secret,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+
+	options := pushOptions()
+
+	status := 0
+	for _, push := range pushes {
+		push.URL = *repo
+		push.Org = *org
+		push.PushOptions = options
+		// A deleted ref has no new head
+		if strings.Trim(push.After, "0") != "" {
+			push.Message = headMessage(push.After)
+		}
+		if err := n.send(push); err != nil {
+			fmt.Fprintf(stderr, "tsuribari notify: %s: %v\n", push.Ref, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+func readSecret(path string) (string, error) {
+	if path == "" {
+		if secret := os.Getenv("TSURIBARI_SECRET"); secret != "" {
+			return secret, nil
+		}
+		return "", errors.New("no secret: set -secret-file or $TSURIBARI_SECRET")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("%s: empty secret", path)
+	}
+	return secret, nil
+}
+
+// readPushes parses the ref updates git passes to a post-receive hook.
+func readPushes(r io.Reader) ([]models.KoanPush, error) {
+	var pushes []models.KoanPush
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("malformed ref update %q", line)
+		}
+		pushes = append(pushes, models.KoanPush{
+			Before: fields[0],
+			After:  fields[1],
+			Ref:    fields[2],
+		})
+	}
+	return pushes, scanner.Err()
+}
+
+// pushOptions returns the options git passes to hooks when
+// receive.advertisePushOptions is set.
+func pushOptions() []string {
+	count, err := strconv.Atoi(os.Getenv("GIT_PUSH_OPTION_COUNT"))
+	if err != nil {
+		return nil
+	}
+
+	options := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		options = append(options, os.Getenv("GIT_PUSH_OPTION_"+strconv.Itoa(i)))
+	}
+	return options
+}
+
+// headMessage returns the message of a commit in the repository the hook
+// runs in, or "" if git cannot find it.
+func headMessage(commit string) string {
+	out, err := exec.Command("git", "log", "-1", "--format=%B", commit).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func (n *notifier) send(push models.KoanPush) error {
+	body, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+
+	deliveryID, err := newDeliveryID()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Koan-Event", "push")
+	req.Header.Set("X-Koan-Delivery", deliveryID)
+	req.Header.Set("X-Koan-Signature", signTimestamped(n.secret, time.Now(), body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		if reason := resp.Header.Get("X-Capnhook"); reason != "" {
+			return fmt.Errorf("%s: %s", resp.Status, reason)
+		}
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// signTimestamped returns an X-Koan-Signature value in the
+// "t=<unix>,v1=<hex sha256>" form, covering "<unix>.<body>".
+func signTimestamped(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newDeliveryID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
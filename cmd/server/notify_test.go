@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"tsuribari/internal/config"
+	"tsuribari/internal/middleware"
+	"tsuribari/internal/models"
+	"tsuribari/internal/providers"
+)
+
+func TestReadPushes(t *testing.T) {
+	input := "1e65c05c1d5171631d92438a13901ca7dae9618c 709d658dc5b6d6afcd46049c2f332ee3f515a67d refs/heads/main\n" +
+		"\n" +
+		"0000000000000000000000000000000000000000 709d658dc5b6d6afcd46049c2f332ee3f515a67d refs/tags/v1.0.0\n"
+
+	pushes, err := readPushes(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(pushes) != 2 {
+		t.Fatalf("Expected 2 pushes, got %d", len(pushes))
+	}
+	if pushes[1].Ref != "refs/tags/v1.0.0" || pushes[1].After != "709d658dc5b6d6afcd46049c2f332ee3f515a67d" {
+		t.Errorf("Unexpected push %+v", pushes[1])
+	}
+
+	if _, err := readPushes(strings.NewReader("refs/heads/main\n")); err == nil {
+		t.Error("Expected error for malformed line, got nil")
+	}
+}
+
+func TestNotify(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	orgs := map[string]config.Organisation{
+		"demo": {Secrets: []config.Secret{{ID: "default", Secret: "koansecret"}}},
+	}
+
+	var workflows []*models.Workflow
+	router := gin.New()
+	router.Use(middleware.HMACValidator(orgs, providers.Default()))
+	router.Use(middleware.ReplayGuard(config.Replay{MaxSkew: time.Minute}))
+	router.POST("/webhooks/:organisation", func(c *gin.Context) {
+		doc, err := models.NewWebhookDoc(c.Param("organisation"), "", models.FlattenHeaders(c.Request.Header), c.MustGet("raw_body").([]byte))
+		if err != nil {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		provider, _ := providers.Default().Get(c.GetString("provider"))
+		workflows = append(workflows, provider.Transform(doc)...)
+		c.Status(http.StatusOK)
+	})
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("koansecret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	stdin := strings.NewReader(
+		"1e65c05c1d5171631d92438a13901ca7dae9618c 709d658dc5b6d6afcd46049c2f332ee3f515a67d refs/heads/main\n" +
+			"1e65c05c1d5171631d92438a13901ca7dae9618c 0000000000000000000000000000000000000000 refs/heads/old\n")
+	var stderr bytes.Buffer
+
+	t.Setenv("GIT_PUSH_OPTION_COUNT", "1")
+	t.Setenv("GIT_PUSH_OPTION_0", "ci.skip")
+
+	status := notify([]string{
+		"-url", server.URL + "/webhooks/demo",
+		"-repo", "git@git.example:demo/repo.git",
+		"-org", "demo",
+		"-secret-file", secretFile,
+	}, stdin, &stderr)
+
+	if status != 0 {
+		t.Fatalf("Expected status 0, got %d: %s", status, stderr.String())
+	}
+	if len(workflows) != 2 {
+		t.Fatalf("Expected 2 workflows, got %d", len(workflows))
+	}
+	if workflows[0].Ref != "709d658dc5b6d6afcd46049c2f332ee3f515a67d" {
+		t.Errorf("Expected Ref '709d658dc5b6d6afcd46049c2f332ee3f515a67d', got '%s'", workflows[0].Ref)
+	}
+	if workflows[0].URL != "git@git.example:demo/repo.git" {
+		t.Errorf("Expected URL 'git@git.example:demo/repo.git', got '%s'", workflows[0].URL)
+	}
+	if len(workflows[0].PushOptions) != 1 || workflows[0].PushOptions[0] != "ci.skip" {
+		t.Errorf("Expected PushOptions [ci.skip], got %v", workflows[0].PushOptions)
+	}
+	if workflows[1].Action != models.ActionDelete || workflows[1].RefName != "refs/heads/old" {
+		t.Errorf("Expected refs/heads/old to be deleted, got %s %s", workflows[1].Action, workflows[1].RefName)
+	}
+}
+
+func TestNotify_Rejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Capnhook", "invalid hmac")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	t.Setenv("TSURIBARI_SECRET", "wrongsecret")
+
+	stdin := strings.NewReader("1e65c05c1d5171631d92438a13901ca7dae9618c 709d658dc5b6d6afcd46049c2f332ee3f515a67d refs/heads/main\n")
+	var stderr bytes.Buffer
+
+	status := notify([]string{
+		"-url", server.URL + "/webhooks/demo",
+		"-repo", "git@git.example:demo/repo.git",
+		"-org", "demo",
+	}, stdin, &stderr)
+
+	if status != 1 {
+		t.Errorf("Expected status 1, got %d", status)
+	}
+	if !strings.Contains(stderr.String(), "invalid hmac") {
+		t.Errorf("Expected rejection reason in output, got %q", stderr.String())
+	}
+}
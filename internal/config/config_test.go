@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -175,3 +176,619 @@ invalid yaml structure
 		t.Error("Expected error with invalid YAML, got nil")
 	}
 }
+
+func TestValidate_MinAlgorithm(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		expectErr bool
+	}{
+		{"Empty", "", false},
+		{"SHA-1", "sha1", false},
+		{"SHA-256", "sha256", false},
+		{"SHA-512", "sha512", false},
+		{"Unknown", "md5", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{
+				Organisations: map[string]Organisation{
+					"demo": {MinAlgorithm: tt.algorithm},
+				},
+			}
+
+			err := config.Validate()
+			if tt.expectErr && err == nil {
+				t.Error("Expected error, got nil")
+			}
+			if !tt.expectErr && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestProvidersFor(t *testing.T) {
+	org := Organisation{
+		Providers: []string{"github"},
+		Pipelines: map[string]Pipeline{
+			"docs":     {},
+			"registry": {Providers: []string{"mapping"}},
+		},
+	}
+
+	if providers := org.ProvidersFor("docs"); len(providers) != 1 || providers[0] != "github" {
+		t.Errorf("Expected organisation providers, got %v", providers)
+	}
+	if providers := org.ProvidersFor("registry"); len(providers) != 1 || providers[0] != "mapping" {
+		t.Errorf("Expected pipeline providers, got %v", providers)
+	}
+}
+
+func TestLoad_EmptyPipeline(t *testing.T) {
+	config := loadTestConfig(t, `
+organisations:
+  demo:
+    secrets:
+      - id: "default"
+        secret: "demosecret"
+    pipelines:
+      docs: {}
+      release:
+        secrets:
+          - id: "release-2025"
+            secret: "fedcba98765432100123456789abcdef"
+`)
+
+	demo := config.Organisations["demo"]
+	for _, pipeline := range []string{"docs", "release"} {
+		if !demo.HasPipeline(pipeline) {
+			t.Errorf("Expected pipeline %s to be declared", pipeline)
+		}
+	}
+	if demo.HasPipeline("missing") {
+		t.Error("Expected pipeline missing not to be declared")
+	}
+	if secrets := demo.SecretsFor("release", time.Now()); len(secrets) != 1 || secrets[0].ID != "release-2025" {
+		t.Errorf("Expected release secrets, got %+v", secrets)
+	}
+}
+
+func TestEventsFor(t *testing.T) {
+	config := loadTestConfig(t, `
+organisations:
+  demo:
+    secrets:
+      - id: "default"
+        secret: "demosecret"
+    events: ["push"]
+    pipelines:
+      docs: {}
+      releases:
+        events: ["push", "Tag Push Hook"]
+`)
+
+	demo := config.Organisations["demo"]
+	if events := demo.EventsFor("docs"); len(events) != 1 || events[0] != "push" {
+		t.Errorf("Expected organisation events, got %v", events)
+	}
+	if events := demo.EventsFor("releases"); len(events) != 2 || events[1] != "Tag Push Hook" {
+		t.Errorf("Expected pipeline events, got %v", events)
+	}
+	if events := (Organisation{}).EventsFor(""); len(events) != 0 {
+		t.Errorf("Expected no events, got %v", events)
+	}
+}
+
+func TestLoad_RefRules(t *testing.T) {
+	config := loadTestConfig(t, `
+organisations:
+  demo:
+    secrets:
+      - id: "default"
+        secret: "demosecret"
+    refs:
+      exclude: ["refs/heads/wip/**"]
+    pipelines:
+      docs: {}
+      release:
+        refs:
+          include: ["refs/heads/main", "refs/tags/v*"]
+`)
+
+	demo := config.Organisations["demo"]
+
+	tests := []struct {
+		pipeline string
+		refName  string
+		expected bool
+	}{
+		{"docs", "refs/heads/feature", true},
+		{"docs", "refs/heads/wip/parser", false},
+		{"release", "refs/heads/main", true},
+		{"release", "refs/tags/v1.2.0", true},
+		{"release", "refs/heads/feature", false},
+		{"release", "", false},
+		{"", "refs/heads/wip/parser", false},
+	}
+
+	for _, tt := range tests {
+		if got := demo.RefsFor(tt.pipeline).Allows(tt.refName); got != tt.expected {
+			t.Errorf("Expected %s allowing %q to be %v", tt.pipeline, tt.refName, tt.expected)
+		}
+	}
+}
+
+func TestValidate_RefRules(t *testing.T) {
+	config := Config{
+		Organisations: map[string]Organisation{
+			"demo": {Pipelines: map[string]Pipeline{
+				"release": {Refs: RefRules{Include: []string{"refs/tags/v[0-9"}}},
+			}},
+		},
+	}
+
+	if err := config.Validate(); err == nil {
+		t.Error("Expected error for malformed pattern, got nil")
+	}
+
+	config.Organisations["demo"].Pipelines["release"] = Pipeline{Paths: PathRules{Exclude: []string{"docs/[a-"}}}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected error for malformed path pattern, got nil")
+	}
+}
+
+func TestSkipsDeletions(t *testing.T) {
+	config := loadTestConfig(t, `
+organisations:
+  demo:
+    secrets:
+      - id: "default"
+        secret: "demosecret"
+    deletions: skip
+    pipelines:
+      docs: {}
+      cleanup:
+        deletions: publish
+`)
+
+	demo := config.Organisations["demo"]
+	if !demo.SkipsDeletions("docs") {
+		t.Error("Expected docs to skip deletions")
+	}
+	if demo.SkipsDeletions("cleanup") {
+		t.Error("Expected cleanup to publish deletions")
+	}
+	if (Organisation{}).SkipsDeletions("") {
+		t.Error("Expected deletions to be published by default")
+	}
+
+	invalid := Config{Organisations: map[string]Organisation{"demo": {Deletions: "ignore"}}}
+	if err := invalid.Validate(); err == nil {
+		t.Error("Expected error for unknown deletions, got nil")
+	}
+}
+
+func TestLoad_SkipRules(t *testing.T) {
+	config := loadTestConfig(t, `
+organisations:
+  demo:
+    secrets:
+      - id: "default"
+        secret: "demosecret"
+    skip:
+      markers: ["[skip ci]", "[ci skip]"]
+      push_options: ["ci.skip"]
+    pipelines:
+      docs: {}
+      deploy:
+        skip:
+          markers: ["[skip deploy]"]
+      release:
+        skip: {}
+`)
+
+	demo := config.Organisations["demo"]
+
+	tests := []struct {
+		pipeline    string
+		message     string
+		pushOptions []string
+		expected    string
+	}{
+		{"docs", "Fix typo [Skip CI]", nil, "[skip ci]"},
+		{"docs", "Fix typo", []string{"ci.skip"}, "ci.skip"},
+		{"docs", "Fix typo", []string{"ci.skip=false"}, ""},
+		{"deploy", "Fix typo [skip ci]", nil, ""},
+		{"deploy", "Fix typo\n\n[skip deploy]", nil, "[skip deploy]"},
+		{"", "Fix typo [ci skip]", nil, "[ci skip]"},
+		{"release", "Fix typo [skip ci]", []string{"ci.skip"}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := demo.SkipFor(tt.pipeline).Match(tt.message, tt.pushOptions); got != tt.expected {
+			t.Errorf("Expected %s to match %q for %q %v, got %q", tt.pipeline, tt.expected, tt.message, tt.pushOptions, got)
+		}
+	}
+
+	if !(Organisation{}).SkipFor("").IsEmpty() {
+		t.Error("Expected no skip rules by default")
+	}
+
+	invalid := Config{Organisations: map[string]Organisation{"demo": {Skip: SkipRules{Markers: []string{" "}}}}}
+	if err := invalid.Validate(); err == nil {
+		t.Error("Expected error for empty marker, got nil")
+	}
+}
+
+func TestLoad_MessageProperties(t *testing.T) {
+	config := loadTestConfig(t, `
+rabbitmq:
+  max_priority: 10
+organisations:
+  demo:
+    secrets:
+      - id: "default"
+        secret: "demosecret"
+    pipelines:
+      deploy:
+        priority: 9
+        expiration: 10m
+`)
+
+	if config.RabbitMQ.MaxPriority != 10 {
+		t.Errorf("Expected max priority 10, got %d", config.RabbitMQ.MaxPriority)
+	}
+	deploy := config.Organisations["demo"].Pipelines["deploy"]
+	if deploy.Priority != 9 || deploy.Expiration != 10*time.Minute {
+		t.Errorf("Expected priority 9 and expiration 10m, got %d %s", deploy.Priority, deploy.Expiration)
+	}
+
+	config.RabbitMQ.MaxPriority = 0
+	if err := config.Validate(); err == nil {
+		t.Error("Expected error for priority without max_priority, got nil")
+	}
+
+	invalid := Config{Organisations: map[string]Organisation{
+		"demo": {Pipelines: map[string]Pipeline{"deploy": {Expiration: -time.Second}}},
+	}}
+	if err := invalid.Validate(); err == nil {
+		t.Error("Expected error for negative expiration, got nil")
+	}
+}
+
+func TestLoad_PathRules(t *testing.T) {
+	config := loadTestConfig(t, `
+organisations:
+  mono:
+    secrets:
+      - id: "default"
+        secret: "monosecret"
+    pipelines:
+      api:
+        paths:
+          include: ["services/api/**", "go.mod"]
+          exclude: ["**/*.md"]
+          publish: true
+      web: {}
+`)
+
+	mono := config.Organisations["mono"]
+	if !mono.PathsFor("web").IsEmpty() {
+		t.Errorf("Expected no path rules for web, got %+v", mono.PathsFor("web"))
+	}
+
+	api := mono.PathsFor("api")
+	if !api.Publish {
+		t.Error("Expected api to publish paths")
+	}
+
+	selected := api.Select([]string{"services/api/main.go", "services/api/README.md", "services/web/app.js", "go.mod"})
+	if len(selected) != 2 || selected[0] != "services/api/main.go" || selected[1] != "go.mod" {
+		t.Errorf("Expected services/api/main.go and go.mod, got %v", selected)
+	}
+	if selected := api.Select([]string{"services/api/README.md"}); len(selected) != 0 {
+		t.Errorf("Expected excluded path not to be selected, got %v", selected)
+	}
+}
+
+func TestLoad_Mapping(t *testing.T) {
+	config := loadTestConfig(t, `
+organisations:
+  tools:
+    secrets:
+      - id: "default"
+        secret: "toolsecret"
+    providers: ["mapping"]
+    mapping:
+      ref: "$.build.commit"
+      url: "git@git.example:{{ $.build.repo }}.git"
+      org: "tools"
+      match:
+        - value: "$header.X-Tool-Event"
+          equals: "build"
+    pipelines:
+      registry:
+        mapping:
+          ref: "$.events[0].target.digest"
+          url: "$.events[0].target.repository"
+          org: "registry"
+`)
+
+	tools := config.Organisations["tools"]
+	if tools.Mapping == nil || tools.Mapping.Ref != "$.build.commit" {
+		t.Fatalf("Expected organisation mapping, got %+v", tools.Mapping)
+	}
+	if len(tools.Mapping.Match) != 1 || tools.Mapping.Match[0].Equals != "build" {
+		t.Errorf("Expected one match condition, got %+v", tools.Mapping.Match)
+	}
+	if mapping := tools.MappingFor("registry"); mapping == nil || mapping.Org != "registry" {
+		t.Errorf("Expected pipeline mapping, got %+v", mapping)
+	}
+	if mapping := tools.MappingFor(""); mapping != tools.Mapping {
+		t.Errorf("Expected organisation mapping, got %+v", mapping)
+	}
+}
+
+func TestValidate_Mapping(t *testing.T) {
+	tests := []struct {
+		name      string
+		mapping   *Mapping
+		expectErr bool
+	}{
+		{"None", nil, false},
+		{"Complete", &Mapping{Ref: "$.sha", URL: "$.url", Org: "tools"}, false},
+		{"Missing org", &Mapping{Ref: "$.sha", URL: "$.url"}, true},
+		{"Match without value", &Mapping{Ref: "$.sha", URL: "$.url", Org: "tools", Match: []Match{{Equals: "build"}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{
+				Organisations: map[string]Organisation{
+					"tools": {Pipelines: map[string]Pipeline{"build": {Mapping: tt.mapping}}},
+				},
+			}
+
+			err := config.Validate()
+			if tt.expectErr && err == nil {
+				t.Error("Expected error, got nil")
+			}
+			if !tt.expectErr && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLoad_RotatingSecrets(t *testing.T) {
+	config := loadTestConfig(t, `
+security:
+  secrets:
+    legacy: "legacysecret"
+
+organisations:
+  demo:
+    secrets:
+      - id: "2024"
+        secret: "oldsecret"
+        not_after: "2025-01-31"
+      - id: "2025"
+        secret: "newsecret"
+        not_before: "2025-01-01T00:00:00Z"
+`)
+
+	demo := config.Organisations["demo"]
+	if len(demo.Secrets) != 2 {
+		t.Fatalf("Expected 2 demo secrets, got %d", len(demo.Secrets))
+	}
+
+	if !demo.Secrets[0].NotAfter.Equal(time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected not_after 2025-01-31, got %v", demo.Secrets[0].NotAfter)
+	}
+
+	during := time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC)
+	if active := demo.ActiveSecrets(during); len(active) != 2 {
+		t.Errorf("Expected both secrets active during overlap, got %d", len(active))
+	}
+
+	after := time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)
+	if active := demo.ActiveSecrets(after); len(active) != 1 || active[0].ID != "2025" {
+		t.Errorf("Expected only secret 2025 active after rotation, got %v", active)
+	}
+
+	legacy := config.Organisations["legacy"]
+	if len(legacy.Secrets) != 1 || legacy.Secrets[0].ID != "default" || legacy.Secrets[0].Secret != "legacysecret" {
+		t.Errorf("Expected legacy secret folded in as default, got %v", legacy.Secrets)
+	}
+}
+
+func TestValidate_Secrets(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		secrets []Secret
+	}{
+		{"Missing id", []Secret{{Secret: "s"}}},
+		{"Duplicate id", []Secret{{ID: "a", Secret: "s"}, {ID: "a", Secret: "t"}}},
+		{"Empty secret", []Secret{{ID: "a"}}},
+		{"Inverted window", []Secret{{ID: "a", Secret: "s", NotBefore: now, NotAfter: now.Add(-time.Hour)}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{
+				Organisations: map[string]Organisation{
+					"demo": {Secrets: tt.secrets},
+				},
+			}
+
+			if err := config.Validate(); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestValidate_ReplayDuplicates(t *testing.T) {
+	for _, mode := range []string{"", "reject", "acknowledge"} {
+		var config Config
+		config.Security.Replay.Duplicates = mode
+		if err := config.Validate(); err != nil {
+			t.Errorf("Expected mode %q to be valid, got %v", mode, err)
+		}
+	}
+
+	var config Config
+	config.Security.Replay.Duplicates = "ignore"
+	if err := config.Validate(); err == nil {
+		t.Error("Expected error for unknown duplicates mode")
+	}
+}
+
+func TestLoad_Outbox(t *testing.T) {
+	config := loadTestConfig(t, `
+outbox:
+  interval: 10s
+  min_backoff: 2s
+  max_backoff: 5m
+  max_attempts: 12
+`)
+
+	if config.Outbox.Interval != 10*time.Second || config.Outbox.MaxBackoff != 5*time.Minute {
+		t.Errorf("Expected interval 10s and max_backoff 5m, got %+v", config.Outbox)
+	}
+	if config.Outbox.MaxAttempts != 12 {
+		t.Errorf("Expected max_attempts 12, got %d", config.Outbox.MaxAttempts)
+	}
+
+	config.Outbox.MinBackoff = 10 * time.Minute
+	if err := config.Validate(); err == nil {
+		t.Error("Expected error for max_backoff below min_backoff, got nil")
+	}
+}
+
+func TestLoad_RabbitMQBindings(t *testing.T) {
+	config := loadTestConfig(t, `
+rabbitmq:
+  routing_key: "{org}.{pipeline}.{event}.{branch}"
+  bindings:
+    - queue: "koans.release"
+      keys: ["*.release.#", "skunkwerks.*.*.main"]
+`)
+
+	if config.RabbitMQ.RoutingKey != "{org}.{pipeline}.{event}.{branch}" {
+		t.Errorf("Expected routing key template, got '%s'", config.RabbitMQ.RoutingKey)
+	}
+	bindings := config.RabbitMQ.Bindings
+	if len(bindings) != 1 || bindings[0].Queue != "koans.release" || len(bindings[0].Keys) != 2 {
+		t.Errorf("Expected koans.release bound with 2 keys, got %+v", bindings)
+	}
+
+	config.RabbitMQ.Bindings[0].Keys = nil
+	if err := config.Validate(); err == nil {
+		t.Error("Expected error for binding without keys, got nil")
+	}
+
+	config.RabbitMQ.Bindings = nil
+	config.RabbitMQ.QueueKeys = []string{"*.*.push.#"}
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected queue keys to be valid, got %v", err)
+	}
+	config.RabbitMQ.RoutingKey = ""
+	if err := config.Validate(); err == nil {
+		t.Error("Expected error for queue keys without routing key, got nil")
+	}
+}
+
+func TestLoad_IPRules(t *testing.T) {
+	config := loadTestConfig(t, `
+organisations:
+  demo:
+    secrets:
+      - id: "default"
+        secret: "demosecret"
+    allowed_ips:
+      - "10.0.0.0/8"
+    denied_ips:
+      - "10.66.0.0/16"
+    pipelines:
+      release:
+        allowed_ips:
+          - "10.1.0.0/16"
+`)
+
+	demo := config.Organisations["demo"]
+	if len(demo.AllowedIPs) != 1 || demo.AllowedIPs[0] != "10.0.0.0/8" {
+		t.Errorf("Expected organisation allowed_ips, got %v", demo.AllowedIPs)
+	}
+	if len(demo.DeniedIPs) != 1 || demo.DeniedIPs[0] != "10.66.0.0/16" {
+		t.Errorf("Expected organisation denied_ips, got %v", demo.DeniedIPs)
+	}
+	if release := demo.Pipelines["release"]; len(release.AllowedIPs) != 1 {
+		t.Errorf("Expected pipeline allowed_ips, got %v", release.AllowedIPs)
+	}
+}
+
+// loadTestConfig reads YAML the way Load does, without touching the
+// global viper instance.
+func loadTestConfig(t *testing.T, content string) Config {
+	t.Helper()
+
+	tmpFile, err := os.CreateTemp("", "config*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Close()
+
+	v := viper.New()
+	v.SetConfigFile(tmpFile.Name())
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatalf("Expected no error reading config, got %v", err)
+	}
+
+	config, err := unmarshal(v)
+	if err != nil {
+		t.Fatalf("Expected no error unmarshaling, got %v", err)
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected valid config, got %v", err)
+	}
+	return *config
+}
+
+func TestValidate_IPEntries(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+	}{
+		{"Trusted IP", func(c *Config) { c.Security.TrustedIPs = []string{"10.0.0.0/8", "10.0.0.300"} }},
+		{"Trusted proxy", func(c *Config) { c.Security.TrustedProxies = []string{"proxy.example.com"} }},
+		{"Organisation allow", func(c *Config) {
+			c.Organisations = map[string]Organisation{"demo": {IPRules: IPRules{AllowedIPs: []string{"10.0.0.0/40"}}}}
+		}},
+		{"Pipeline deny", func(c *Config) {
+			c.Organisations = map[string]Organisation{"demo": {Pipelines: map[string]Pipeline{
+				"release": {IPRules: IPRules{DeniedIPs: []string{"not-an-ip"}}},
+			}}}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config Config
+			tt.modify(&config)
+			if err := config.Validate(); err == nil {
+				t.Error("Expected error for invalid entry, got nil")
+			}
+		})
+	}
+}
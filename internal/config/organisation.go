@@ -0,0 +1,455 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"tsuribari/internal/glob"
+)
+
+// Organisation holds per-organisation policy.
+type Organisation struct {
+	// MinAlgorithm is the weakest signature accepted for this
+	// organisation: token, sha1, sha256 or sha512. Empty accepts all.
+	MinAlgorithm string `mapstructure:"min_algorithm"`
+
+	// Providers limits which senders the organisation accepts webhooks
+	// from, such as github or bitbucket-cloud. Empty accepts all, and a
+	// single provider is used without detection. Names are checked
+	// against the provider registry at startup.
+	Providers []string `mapstructure:"providers"`
+
+	// Events limits which events produce workflows, such as push or
+	// "Tag Push Hook", using the provider's names. Other events are
+	// stored and acknowledged but ignored. Empty builds every event the
+	// provider supports.
+	Events []string `mapstructure:"events"`
+
+	// Refs selects the branches and tags that produce workflows.
+	Refs RefRules `mapstructure:"refs"`
+
+	// Deletions is publish, the default, to send a delete workflow when
+	// a branch or tag is deleted, or skip.
+	Deletions string `mapstructure:"deletions"`
+
+	// Skip lets developers push without building.
+	Skip SkipRules `mapstructure:"skip"`
+
+	// Secrets lists every key a sender may sign with. Several can be
+	// valid at once so that rotation needs no flag day.
+	Secrets []Secret `mapstructure:"secrets"`
+
+	// Pipelines declares the pipelines that may be addressed as
+	// /webhooks/:organisation/:pipeline.
+	Pipelines map[string]Pipeline `mapstructure:"pipelines"`
+
+	// Mapping builds workflows for the mapping provider.
+	Mapping *Mapping `mapstructure:"mapping"`
+
+	IPRules `mapstructure:",squash"`
+}
+
+// Pipeline holds per-pipeline policy within an organisation.
+type Pipeline struct {
+	// Secrets replaces the organisation secrets for this pipeline.
+	// When empty, the organisation secrets apply.
+	Secrets []Secret `mapstructure:"secrets"`
+
+	// Providers, Events, Refs, Deletions, Skip and Mapping replace those
+	// of the organisation for this pipeline. When empty, the
+	// organisation's apply, except for Skip, which replaces them as soon
+	// as it is set, so that `skip: {}` turns skipping off.
+	Providers []string   `mapstructure:"providers"`
+	Events    []string   `mapstructure:"events"`
+	Refs      RefRules   `mapstructure:"refs"`
+	Deletions string     `mapstructure:"deletions"`
+	Skip      *SkipRules `mapstructure:"skip"`
+	Mapping   *Mapping   `mapstructure:"mapping"`
+
+	// Paths limits the pipeline to pushes changing selected files, for
+	// repositories holding several projects.
+	Paths PathRules `mapstructure:"paths"`
+
+	// Priority and Expiration are set on the messages of the pipeline's
+	// workflows, unless zero.
+	Priority   uint8         `mapstructure:"priority"`
+	Expiration time.Duration `mapstructure:"expiration"`
+
+	IPRules `mapstructure:",squash"`
+}
+
+// Mapping declares how the mapping provider builds a workflow from an
+// arbitrary webhook. Ref, URL and Org are expressions over the body and
+// headers, such as `$.commit.sha` or `git@git.example:{{ $.repo }}.git`,
+// and every Match must hold for a workflow to be produced. RefName, the
+// full name of the ref such as refs/heads/main, is optional.
+type Mapping struct {
+	Ref     string  `mapstructure:"ref"`
+	RefName string  `mapstructure:"ref_name"`
+	URL     string  `mapstructure:"url"`
+	Org     string  `mapstructure:"org"`
+	Match   []Match `mapstructure:"match"`
+}
+
+// Match is a condition on the value of an expression: equal to Equals,
+// matching the regular expression Pattern, or, with neither, not empty.
+type Match struct {
+	Value   string `mapstructure:"value"`
+	Equals  string `mapstructure:"equals"`
+	Pattern string `mapstructure:"pattern"`
+}
+
+// RefRules select refs by their full name, such as refs/heads/main or
+// refs/tags/v1.0.0. A ref must match one of Include, when it is not
+// empty, and none of Exclude. Patterns are globs in which `*` matches
+// within one segment of the name and `**` across segments.
+type RefRules struct {
+	Include []string `mapstructure:"include"`
+	Exclude []string `mapstructure:"exclude"`
+}
+
+// PathRules select pushes by the paths their commits change. A path is
+// selected when it matches one of Include, if given, and none of
+// Exclude, and a push when any of its paths is. Patterns are globs as
+// for RefRules. With Publish, the selected paths are sent in the
+// workflow.
+type PathRules struct {
+	Include []string `mapstructure:"include"`
+	Exclude []string `mapstructure:"exclude"`
+	Publish bool     `mapstructure:"publish"`
+}
+
+// SkipRules let a push opt out of building. Markers are looked for,
+// ignoring case, in the message of the commit built, such as "[skip ci]",
+// and PushOptions are compared with the options given to `git push -o`,
+// such as "ci.skip".
+type SkipRules struct {
+	Markers     []string `mapstructure:"markers"`
+	PushOptions []string `mapstructure:"push_options"`
+}
+
+// IPRules narrow the global trusted IPs for an organisation or pipeline.
+// A client matching DeniedIPs is refused; when AllowedIPs is not empty,
+// the client must match it.
+type IPRules struct {
+	AllowedIPs []string `mapstructure:"allowed_ips"`
+	DeniedIPs  []string `mapstructure:"denied_ips"`
+}
+
+// Secret is one HMAC key, optionally limited to a validity window.
+type Secret struct {
+	ID        string    `mapstructure:"id"`
+	Secret    string    `mapstructure:"secret"`
+	NotBefore time.Time `mapstructure:"not_before"`
+	NotAfter  time.Time `mapstructure:"not_after"`
+}
+
+// ActiveAt reports whether the secret may be used at time t.
+func (s Secret) ActiveAt(t time.Time) bool {
+	if !s.NotBefore.IsZero() && t.Before(s.NotBefore) {
+		return false
+	}
+	if !s.NotAfter.IsZero() && !t.Before(s.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// ActiveSecrets returns the secrets valid at time t, in configured order.
+func (o Organisation) ActiveSecrets(t time.Time) []Secret {
+	var active []Secret
+	for _, secret := range o.Secrets {
+		if secret.ActiveAt(t) {
+			active = append(active, secret)
+		}
+	}
+	return active
+}
+
+// SecretsFor returns the secrets valid at time t for the given pipeline,
+// falling back to the organisation secrets when the pipeline has none.
+func (o Organisation) SecretsFor(pipeline string, t time.Time) []Secret {
+	if p, ok := o.Pipelines[pipeline]; ok && len(p.Secrets) > 0 {
+		return Organisation{Secrets: p.Secrets}.ActiveSecrets(t)
+	}
+	return o.ActiveSecrets(t)
+}
+
+// HasPipeline reports whether the pipeline is declared. The empty
+// pipeline, used by /webhooks/:organisation, always exists.
+func (o Organisation) HasPipeline(pipeline string) bool {
+	if pipeline == "" {
+		return true
+	}
+	_, ok := o.Pipelines[pipeline]
+	return ok
+}
+
+// ProvidersFor returns the providers accepted for the given pipeline,
+// falling back to the organisation's when the pipeline lists none.
+func (o Organisation) ProvidersFor(pipeline string) []string {
+	if p, ok := o.Pipelines[pipeline]; ok && len(p.Providers) > 0 {
+		return p.Providers
+	}
+	return o.Providers
+}
+
+// EventsFor returns the events that produce workflows for the given
+// pipeline, falling back to the organisation's when the pipeline lists
+// none.
+func (o Organisation) EventsFor(pipeline string) []string {
+	if p, ok := o.Pipelines[pipeline]; ok && len(p.Events) > 0 {
+		return p.Events
+	}
+	return o.Events
+}
+
+// RefsFor returns the ref rules for the given pipeline, falling back to
+// the organisation's when the pipeline has none.
+func (o Organisation) RefsFor(pipeline string) RefRules {
+	if p, ok := o.Pipelines[pipeline]; ok && !p.Refs.IsEmpty() {
+		return p.Refs
+	}
+	return o.Refs
+}
+
+// SkipsDeletions reports whether the given pipeline, or failing a
+// setting the organisation, skips deleted branches and tags.
+func (o Organisation) SkipsDeletions(pipeline string) bool {
+	if p, ok := o.Pipelines[pipeline]; ok && p.Deletions != "" {
+		return p.Deletions == "skip"
+	}
+	return o.Deletions == "skip"
+}
+
+// SkipFor returns the skip rules for the given pipeline, falling back to
+// the organisation's when the pipeline sets none.
+func (o Organisation) SkipFor(pipeline string) SkipRules {
+	if p, ok := o.Pipelines[pipeline]; ok && p.Skip != nil {
+		return *p.Skip
+	}
+	return o.Skip
+}
+
+// PathsFor returns the path rules of the given pipeline.
+func (o Organisation) PathsFor(pipeline string) PathRules {
+	return o.Pipelines[pipeline].Paths
+}
+
+// MappingFor returns the mapping for the given pipeline, falling back to
+// the organisation's, or nil if neither declares one.
+func (o Organisation) MappingFor(pipeline string) *Mapping {
+	if p, ok := o.Pipelines[pipeline]; ok && p.Mapping != nil {
+		return p.Mapping
+	}
+	return o.Mapping
+}
+
+func (o Organisation) validate() error {
+	switch o.MinAlgorithm {
+	case "", "token", "sha1", "sha256", "sha512":
+	default:
+		return fmt.Errorf("unknown min_algorithm %q", o.MinAlgorithm)
+	}
+
+	if err := validateSecrets(o.Secrets); err != nil {
+		return err
+	}
+	if err := o.IPRules.validate(); err != nil {
+		return err
+	}
+	if err := o.Refs.validate(); err != nil {
+		return err
+	}
+	if err := validateDeletions(o.Deletions); err != nil {
+		return err
+	}
+	if err := o.Skip.validate(); err != nil {
+		return err
+	}
+	if err := o.Mapping.validate(); err != nil {
+		return err
+	}
+
+	for name, pipeline := range o.Pipelines {
+		if err := validateSecrets(pipeline.Secrets); err != nil {
+			return fmt.Errorf("pipeline %s: %w", name, err)
+		}
+		if err := pipeline.IPRules.validate(); err != nil {
+			return fmt.Errorf("pipeline %s: %w", name, err)
+		}
+		if err := pipeline.Refs.validate(); err != nil {
+			return fmt.Errorf("pipeline %s: %w", name, err)
+		}
+		if err := validateDeletions(pipeline.Deletions); err != nil {
+			return fmt.Errorf("pipeline %s: %w", name, err)
+		}
+		if pipeline.Skip != nil {
+			if err := pipeline.Skip.validate(); err != nil {
+				return fmt.Errorf("pipeline %s: %w", name, err)
+			}
+		}
+		if err := pipeline.Paths.validate(); err != nil {
+			return fmt.Errorf("pipeline %s: %w", name, err)
+		}
+		if pipeline.Expiration < 0 {
+			return fmt.Errorf("pipeline %s: negative expiration", name)
+		}
+		if err := pipeline.Mapping.validate(); err != nil {
+			return fmt.Errorf("pipeline %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (r IPRules) validate() error {
+	if err := validateIPs("allowed_ips", r.AllowedIPs); err != nil {
+		return err
+	}
+	return validateIPs("denied_ips", r.DeniedIPs)
+}
+
+// IsEmpty reports whether the rules select every ref.
+func (r RefRules) IsEmpty() bool {
+	return len(r.Include) == 0 && len(r.Exclude) == 0
+}
+
+// Allows reports whether the rules select the named ref. With include
+// rules, a ref of unknown name is not selected.
+func (r RefRules) Allows(refName string) bool {
+	if len(r.Include) > 0 && !glob.MatchAny(r.Include, refName) {
+		return false
+	}
+	return !glob.MatchAny(r.Exclude, refName)
+}
+
+func (r RefRules) validate() error {
+	if err := validatePatterns("refs.include", r.Include); err != nil {
+		return err
+	}
+	return validatePatterns("refs.exclude", r.Exclude)
+}
+
+// IsEmpty reports whether the rules select every push.
+func (r PathRules) IsEmpty() bool {
+	return len(r.Include) == 0 && len(r.Exclude) == 0
+}
+
+// Select returns the paths the rules select, in order.
+func (r PathRules) Select(paths []string) []string {
+	var selected []string
+	for _, path := range paths {
+		if len(r.Include) > 0 && !glob.MatchAny(r.Include, path) {
+			continue
+		}
+		if glob.MatchAny(r.Exclude, path) {
+			continue
+		}
+		selected = append(selected, path)
+	}
+	return selected
+}
+
+// IsEmpty reports whether the rules never skip.
+func (r SkipRules) IsEmpty() bool {
+	return len(r.Markers) == 0 && len(r.PushOptions) == 0
+}
+
+// Match returns the marker found in the commit message, or the push
+// option given, that asks for the push to be skipped, or "".
+func (r SkipRules) Match(message string, pushOptions []string) string {
+	lower := strings.ToLower(message)
+	for _, marker := range r.Markers {
+		if strings.Contains(lower, strings.ToLower(marker)) {
+			return marker
+		}
+	}
+	for _, option := range r.PushOptions {
+		for _, given := range pushOptions {
+			if option == given {
+				return option
+			}
+		}
+	}
+	return ""
+}
+
+// validate refuses empty markers and options, which would skip every
+// push.
+func (r SkipRules) validate() error {
+	for _, marker := range r.Markers {
+		if strings.TrimSpace(marker) == "" {
+			return errors.New("skip.markers: empty marker")
+		}
+	}
+	for _, option := range r.PushOptions {
+		if option == "" {
+			return errors.New("skip.push_options: empty option")
+		}
+	}
+	return nil
+}
+
+func (r PathRules) validate() error {
+	if err := validatePatterns("paths.include", r.Include); err != nil {
+		return err
+	}
+	return validatePatterns("paths.exclude", r.Exclude)
+}
+
+func validateDeletions(deletions string) error {
+	switch deletions {
+	case "", "publish", "skip":
+		return nil
+	}
+	return fmt.Errorf("unknown deletions %q", deletions)
+}
+
+func validatePatterns(field string, patterns []string) error {
+	for _, pattern := range patterns {
+		if err := glob.Validate(pattern); err != nil {
+			return fmt.Errorf("%s: invalid pattern %q", field, pattern)
+		}
+	}
+	return nil
+}
+
+// validate checks that the required expressions are present. Their
+// syntax is checked when the mapping provider compiles them.
+func (m *Mapping) validate() error {
+	if m == nil {
+		return nil
+	}
+	if m.Ref == "" || m.URL == "" || m.Org == "" {
+		return errors.New("mapping needs ref, url and org")
+	}
+	for _, match := range m.Match {
+		if match.Value == "" {
+			return errors.New("mapping match without value")
+		}
+	}
+	return nil
+}
+
+func validateSecrets(secrets []Secret) error {
+	seen := make(map[string]bool)
+	for _, secret := range secrets {
+		if secret.ID == "" {
+			return errors.New("secret without id")
+		}
+		if seen[secret.ID] {
+			return fmt.Errorf("duplicate secret id %q", secret.ID)
+		}
+		seen[secret.ID] = true
+
+		if secret.Secret == "" {
+			return fmt.Errorf("secret %s: empty secret", secret.ID)
+		}
+		if !secret.NotBefore.IsZero() && !secret.NotAfter.IsZero() && !secret.NotAfter.After(secret.NotBefore) {
+			return fmt.Errorf("secret %s: not_after must be later than not_before", secret.ID)
+		}
+	}
+	return nil
+}
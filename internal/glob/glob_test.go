@@ -0,0 +1,63 @@
+package glob
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"refs/heads/main", "refs/heads/main", true},
+		{"refs/heads/main", "refs/heads/maintenance", false},
+		{"refs/tags/v*", "refs/tags/v1.2.0", true},
+		{"refs/tags/v*", "refs/tags/release-1", false},
+		{"refs/heads/*", "refs/heads/feature/login", false},
+		{"refs/heads/**", "refs/heads/feature/login", true},
+		{"refs/heads/**", "refs/heads", true},
+		{"refs/**/**", "refs", true},
+		{"services/api/**", "services/api/cmd/main.go", true},
+		{"services/api/**", "services/web/index.html", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "internal/glob/glob.go", true},
+		{"**/*.go", "README.md", false},
+		{"docs/**/*.md", "docs/README.md", true},
+		{"docs/**/*.md", "docs/api/v1/index.md", true},
+		{"docs/**/*.md", "src/api/index.md", false},
+		{"refs/heads/release-[0-9]*", "refs/heads/release-2024", true},
+		{"refs/heads/[", "refs/heads/[", false},
+	}
+
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.name); got != tt.expected {
+			t.Errorf("Match(%q, %q) = %v, expected %v", tt.pattern, tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestMatchAny(t *testing.T) {
+	patterns := []string{"refs/heads/main", "refs/tags/**"}
+
+	if !MatchAny(patterns, "refs/tags/v1.0.0") {
+		t.Error("Expected tag to match")
+	}
+	if MatchAny(patterns, "refs/heads/develop") {
+		t.Error("Expected develop not to match")
+	}
+	if MatchAny(nil, "refs/heads/main") {
+		t.Error("Expected no patterns to match nothing")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, pattern := range []string{"refs/heads/main", "refs/tags/v*", "**/*.go", "src/[a-z]?/**"} {
+		if err := Validate(pattern); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"refs/heads/[", "src/[a-/**", `refs/\`} {
+		if err := Validate(pattern); err == nil {
+			t.Errorf("Expected %q to be invalid", pattern)
+		}
+	}
+}
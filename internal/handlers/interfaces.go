@@ -3,10 +3,10 @@ package handlers
 import "tsuribari/internal/models"
 
 type Storage interface {
-	StoreWebhook(headers map[string]string, body []byte) (*models.WebhookDoc, error)
+	StoreWebhook(doc *models.WebhookDoc) error
 }
 
-type Queue interface {
-	PublishWorkflow(workflow *models.Workflow) error
-	Close() error
+// Outbox publishes the workflows of stored webhooks in the background.
+type Outbox interface {
+	Dispatch(id string)
 }
@@ -1,22 +1,32 @@
 package handlers
 
 import (
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 
+	"tsuribari/internal/config"
 	"tsuribari/internal/models"
+	"tsuribari/internal/providers"
 )
 
 type WebhookHandler struct {
-	storage Storage
-	queue   Queue
+	storage   Storage
+	outbox    Outbox
+	providers *providers.Registry
+	orgs      map[string]config.Organisation
 }
 
-func NewWebhookHandler(storage Storage, queue Queue) *WebhookHandler {
+func NewWebhookHandler(storage Storage, outbox Outbox, registry *providers.Registry, orgs map[string]config.Organisation) *WebhookHandler {
 	return &WebhookHandler{
-		storage: storage,
-		queue:   queue,
+		storage:   storage,
+		outbox:    outbox,
+		providers: registry,
+		orgs:      orgs,
 	}
 }
 
@@ -30,42 +40,203 @@ func (h *WebhookHandler) HandleWebhook(c *gin.Context) {
 
 	body := rawBody.([]byte)
 
-	// Extract headers
-	headers := make(map[string]string)
-	for name, values := range c.Request.Header {
-		if len(values) > 0 {
-			headers[name] = values[0]
+	doc, err := models.NewWebhookDoc(c.Param("organisation"), c.Param("pipeline"), models.FlattenHeaders(c.Request.Header), body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json body"})
+		return
+	}
+
+	// Use the provider resolved by HMACValidator, or detect one
+	provider, ok := h.providers.Get(c.GetString("provider"))
+	if !ok {
+		provider = h.providers.Detect(c.Request.Header)
+	}
+	doc.Provider = provider.Name()
+	doc.Event = provider.Event(c.Request.Header)
+	doc.SecretID = c.GetString("secret_id")
+	doc.DeliveryID = c.GetString("delivery_id")
+
+	// Correlate messages with the request, as logged by a reverse
+	// proxy, or failing that with the sender's delivery
+	doc.CorrelationID = c.GetHeader("X-Request-Id")
+	if doc.CorrelationID == "" {
+		doc.CorrelationID = doc.DeliveryID
+	}
+
+	// Answer pings without storing them, as they describe no change
+	if providers.IsPing(doc.Event) {
+		c.JSON(http.StatusOK, gin.H{"message": "pong"})
+		return
+	}
+
+	// Keep ignored events for auditing, but build nothing from them
+	if !h.builds(doc, provider) {
+		if err := h.storage.StoreWebhook(doc); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store webhook"})
+			return
 		}
+		log.Printf("INFO: ignoring %s event '%s' for %s", doc.Provider, doc.Event, doc.ID)
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "webhook stored but event ignored",
+			"event":   doc.Event,
+			"id":      doc.ID,
+		})
+		return
 	}
 
-	// Store webhook in CouchDB
-	doc, err := h.storage.StoreWebhook(headers, body)
-	if err != nil {
+	// Transform to one workflow per updated ref, before storing, so
+	// that transform errors are kept with the webhook
+	workflows := provider.Transform(doc)
+	workflows = h.filter(doc, workflows)
+	if len(workflows) > 0 {
+		doc.Workflows = workflows
+		doc.PublishStatus = models.PublishPending
+
+		pipeline := h.orgs[doc.Organisation].Pipelines[doc.Pipeline]
+		doc.Priority = pipeline.Priority
+		if pipeline.Expiration > 0 {
+			doc.Expiration = strconv.FormatInt(pipeline.Expiration.Milliseconds(), 10)
+		}
+	}
+
+	// Store webhook in CouchDB, along with the workflows to publish
+	if err := h.storage.StoreWebhook(doc); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store webhook"})
 		return
 	}
 
-	// Transform to workflow
-	workflow := models.TransformWebhookToWorkflow(doc)
-	if workflow == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"message": "webhook stored but cannot transform to workflow",
+	if doc.Status == models.StatusSkipped {
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "webhook stored but skipped",
+			"reason":  doc.SkipReason,
 			"id":      doc.ID,
 		})
 		return
 	}
 
-	// Publish to RabbitMQ
-	if err := h.queue.PublishWorkflow(workflow); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "failed to publish workflow",
-			"id":    doc.ID,
-		})
+	if len(workflows) == 0 {
+		response := gin.H{
+			"message": "webhook stored but cannot transform to workflow",
+			"id":      doc.ID,
+		}
+		if doc.TransformError != "" {
+			response["transform_error"] = doc.TransformError
+		}
+		c.JSON(http.StatusOK, response)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	// Publish to RabbitMQ in the background: once stored, the workflows
+	// are retried until the broker takes them
+	h.outbox.Dispatch(doc.ID)
+
+	c.JSON(http.StatusAccepted, gin.H{
 		"message": "you have achieved enlightenment",
 		"id":      doc.ID,
 	})
 }
+
+// builds reports whether the document's event should produce workflows:
+// it is listed for the organisation or pipeline or, failing a list,
+// supported by the provider. Requests that name no event are built.
+func (h *WebhookHandler) builds(doc *models.WebhookDoc, provider providers.Provider) bool {
+	if doc.Event == "" {
+		return true
+	}
+
+	events := h.orgs[doc.Organisation].EventsFor(doc.Pipeline)
+	if len(events) == 0 {
+		events = provider.Events()
+	}
+	for _, event := range events {
+		if event == doc.Event {
+			return true
+		}
+	}
+	return false
+}
+
+// rules are the organisation or pipeline settings selecting the
+// workflows to publish.
+type rules struct {
+	refs          config.RefRules
+	paths         config.PathRules
+	skip          config.SkipRules
+	skipDeletions bool
+}
+
+func rulesFor(org config.Organisation, pipeline string) rules {
+	return rules{
+		refs:          org.RefsFor(pipeline),
+		paths:         org.PathsFor(pipeline),
+		skip:          org.SkipFor(pipeline),
+		skipDeletions: org.SkipsDeletions(pipeline),
+	}
+}
+
+// filter drops the workflows the organisation or pipeline does not
+// build, because of their ref, because they delete it, because the
+// developer asked, or because of the paths they change. If none is left,
+// the document is marked as skipped.
+func (h *WebhookHandler) filter(doc *models.WebhookDoc, workflows []*models.Workflow) []*models.Workflow {
+	r := rulesFor(h.orgs[doc.Organisation], doc.Pipeline)
+
+	var kept []*models.Workflow
+	var reasons []string
+	marker := ""
+	for _, workflow := range workflows {
+		reason, matched := r.skipReason(workflow)
+		if reason == "" {
+			kept = append(kept, workflow)
+			continue
+		}
+		log.Printf("INFO: skipping workflow for %s: %s", doc.ID, reason)
+		reasons = append(reasons, reason)
+		if marker == "" {
+			marker = matched
+		}
+	}
+
+	if len(kept) == 0 && len(reasons) > 0 {
+		doc.Status = models.StatusSkipped
+		doc.SkipReason = strings.Join(reasons, "; ")
+		doc.SkipMarker = marker
+	}
+	return kept
+}
+
+// skipReason says why the rules do not select the workflow, with the
+// skip marker that matched, if any, or returns "". Pushes whose changed
+// paths are unknown are built.
+func (r rules) skipReason(workflow *models.Workflow) (reason, marker string) {
+	refName := workflow.RefName
+	if refName == "" {
+		refName = "unnamed ref"
+	}
+
+	if !r.refs.Allows(workflow.RefName) {
+		return refName + " not selected", ""
+	}
+	if workflow.Action == models.ActionDelete {
+		if r.skipDeletions {
+			return refName + " deleted", ""
+		}
+		return "", ""
+	}
+
+	if marker := r.skip.Match(workflow.Message, workflow.PushOptions); marker != "" {
+		return fmt.Sprintf("%s skipped by %q", refName, marker), marker
+	}
+
+	if r.paths.IsEmpty() || workflow.Changes == nil {
+		return "", ""
+	}
+	selected := r.paths.Select(workflow.Changes)
+	if len(selected) == 0 {
+		return "no selected path changed in " + refName, ""
+	}
+	if r.paths.Publish {
+		workflow.Paths = selected
+	}
+	return "", ""
+}
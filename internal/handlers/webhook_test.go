@@ -6,39 +6,50 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"tsuribari/internal/config"
 	"tsuribari/internal/models"
+	"tsuribari/internal/providers"
 )
 
 // Mock storage
 type MockStorage struct {
-	storeWebhookFunc func(headers map[string]string, body []byte) (*models.WebhookDoc, error)
+	storeWebhookFunc func(doc *models.WebhookDoc) error
 }
 
-func (m *MockStorage) StoreWebhook(headers map[string]string, body []byte) (*models.WebhookDoc, error) {
+func (m *MockStorage) StoreWebhook(doc *models.WebhookDoc) error {
 	if m.storeWebhookFunc != nil {
-		return m.storeWebhookFunc(headers, body)
+		return m.storeWebhookFunc(doc)
 	}
-	return nil, errors.New("not implemented")
+	return errors.New("not implemented")
 }
 
-// Mock queue
-type MockQueue struct {
-	publishWorkflowFunc func(workflow *models.Workflow) error
+// Mock outbox
+type MockOutbox struct {
+	dispatched []string
 }
 
-func (m *MockQueue) PublishWorkflow(workflow *models.Workflow) error {
-	if m.publishWorkflowFunc != nil {
-		return m.publishWorkflowFunc(workflow)
-	}
-	return errors.New("not implemented")
+func (m *MockOutbox) Dispatch(id string) {
+	m.dispatched = append(m.dispatched, id)
 }
 
-func (m *MockQueue) Close() error {
-	return nil
+const pushBody = `{
+	"repository": {
+		"ssh_url": "git@github.com:test/repo.git",
+		"owner": {"login": "test"}
+	},
+	"head_commit": {"id": "abc123"}
+}`
+
+func docID(body string) string {
+	doc, _ := models.NewWebhookDoc("", "", nil, []byte(body))
+	return doc.ID
 }
 
 func TestHandleWebhook_ResponseContainsDocID(t *testing.T) {
@@ -46,87 +57,45 @@ func TestHandleWebhook_ResponseContainsDocID(t *testing.T) {
 
 	tests := []struct {
 		name           string
-		setupMocks     func(*MockStorage, *MockQueue)
+		body           string
+		setupMocks     func(*MockStorage)
 		expectedStatus int
-		expectedDocID  string
 	}{
 		{
 			name: "Success response includes doc_id",
-			setupMocks: func(storage *MockStorage, queue *MockQueue) {
-				doc := &models.WebhookDoc{
-					ID: "test-doc-123",
-					Body: map[string]interface{}{
-						"repository": map[string]interface{}{
-							"ssh_url": "git@github.com:test/repo.git",
-							"owner":   map[string]interface{}{"login": "test"},
-						},
-						"head_commit": map[string]interface{}{"id": "abc123"},
-					},
-				}
-				storage.storeWebhookFunc = func(headers map[string]string, body []byte) (*models.WebhookDoc, error) {
-					return doc, nil
-				}
-				queue.publishWorkflowFunc = func(workflow *models.Workflow) error {
+			body: pushBody,
+			setupMocks: func(storage *MockStorage) {
+				storage.storeWebhookFunc = func(doc *models.WebhookDoc) error {
 					return nil
 				}
 			},
-			expectedStatus: http.StatusOK,
-			expectedDocID:  "test-doc-123",
+			expectedStatus: http.StatusAccepted,
 		},
 		{
 			name: "Transform failure response includes doc_id",
-			setupMocks: func(storage *MockStorage, queue *MockQueue) {
-				doc := &models.WebhookDoc{
-					ID:   "test-doc-456",
-					Body: map[string]interface{}{"invalid": "structure"},
-				}
-				storage.storeWebhookFunc = func(headers map[string]string, body []byte) (*models.WebhookDoc, error) {
-					return doc, nil
+			body: `{"invalid": "structure"}`,
+			setupMocks: func(storage *MockStorage) {
+				storage.storeWebhookFunc = func(doc *models.WebhookDoc) error {
+					return nil
 				}
 			},
 			expectedStatus: http.StatusOK,
-			expectedDocID:  "test-doc-456",
-		},
-		{
-			name: "Queue failure response includes doc_id",
-			setupMocks: func(storage *MockStorage, queue *MockQueue) {
-				doc := &models.WebhookDoc{
-					ID: "test-doc-789",
-					Body: map[string]interface{}{
-						"repository": map[string]interface{}{
-							"ssh_url": "git@github.com:test/repo.git",
-							"owner":   map[string]interface{}{"login": "test"},
-						},
-						"head_commit": map[string]interface{}{"id": "abc123"},
-					},
-				}
-				storage.storeWebhookFunc = func(headers map[string]string, body []byte) (*models.WebhookDoc, error) {
-					return doc, nil
-				}
-				queue.publishWorkflowFunc = func(workflow *models.Workflow) error {
-					return errors.New("queue error")
-				}
-			},
-			expectedStatus: http.StatusInternalServerError,
-			expectedDocID:  "test-doc-789",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mockStorage := &MockStorage{}
-			mockQueue := &MockQueue{}
-			handler := NewWebhookHandler(mockStorage, mockQueue)
+			handler := NewWebhookHandler(mockStorage, &MockOutbox{}, providers.Default(), nil)
 
-			tt.setupMocks(mockStorage, mockQueue)
+			tt.setupMocks(mockStorage)
 
-			body := `{"test": "data"}`
-			req := httptest.NewRequest("POST", "/webhooks/test", bytes.NewBufferString(body))
+			req := httptest.NewRequest("POST", "/webhooks/test", bytes.NewBufferString(tt.body))
 			w := httptest.NewRecorder()
 
 			c, _ := gin.CreateTestContext(w)
 			c.Request = req
-			c.Set("raw_body", []byte(body))
+			c.Set("raw_body", []byte(tt.body))
 
 			handler.HandleWebhook(c)
 
@@ -139,9 +108,650 @@ func TestHandleWebhook_ResponseContainsDocID(t *testing.T) {
 				t.Fatalf("Failed to unmarshal response: %v", err)
 			}
 
-			if response["id"] != tt.expectedDocID {
-				t.Errorf("Expected doc_id %s, got %v", tt.expectedDocID, response["id"])
+			if expected := docID(tt.body); response["id"] != expected {
+				t.Errorf("Expected doc_id %s, got %v", expected, response["id"])
+			}
+		})
+	}
+}
+
+func TestHandleWebhook_StoresPendingWorkflows(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name           string
+		storeErr       error
+		expectedStatus int
+		dispatched     int
+	}{
+		{"Stored", nil, http.StatusAccepted, 1},
+		{"Storage failure", errors.New("couchdb down"), http.StatusInternalServerError, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stored *models.WebhookDoc
+			mockStorage := &MockStorage{
+				storeWebhookFunc: func(doc *models.WebhookDoc) error {
+					stored = doc
+					return tt.storeErr
+				},
+			}
+			mockOutbox := &MockOutbox{}
+			handler := NewWebhookHandler(mockStorage, mockOutbox, providers.Default(), nil)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/webhooks/test", bytes.NewBufferString(pushBody))
+			c.Set("raw_body", []byte(pushBody))
+
+			handler.HandleWebhook(c)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if stored.PublishStatus != models.PublishPending || len(stored.Workflows) != 1 {
+				t.Errorf("Expected 1 pending workflow, got %s %d", stored.PublishStatus, len(stored.Workflows))
+			}
+			if len(mockOutbox.dispatched) != tt.dispatched {
+				t.Fatalf("Expected %d dispatched, got %v", tt.dispatched, mockOutbox.dispatched)
+			}
+			if tt.dispatched > 0 && mockOutbox.dispatched[0] != stored.ID {
+				t.Errorf("Expected %s dispatched, got %s", stored.ID, mockOutbox.dispatched[0])
 			}
 		})
 	}
 }
+
+func TestHandleWebhook_SameBodyForTwoPipelines(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// Keep the first document stored under an ID, as CouchDB does
+	stored := map[string]*models.WebhookDoc{}
+	mockStorage := &MockStorage{
+		storeWebhookFunc: func(doc *models.WebhookDoc) error {
+			if _, ok := stored[doc.ID]; !ok {
+				stored[doc.ID] = doc
+			}
+			return nil
+		},
+	}
+	mockOutbox := &MockOutbox{}
+	handler := NewWebhookHandler(mockStorage, mockOutbox, providers.Default(), nil)
+
+	for _, pipeline := range []string{"frontend", "backend"} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/webhooks/acme/"+pipeline, bytes.NewBufferString(pushBody))
+		c.Params = gin.Params{{Key: "organisation", Value: "acme"}, {Key: "pipeline", Value: pipeline}}
+		c.Set("raw_body", []byte(pushBody))
+
+		handler.HandleWebhook(c)
+
+		if w.Code != http.StatusAccepted {
+			t.Errorf("Expected status %d for %s, got %d", http.StatusAccepted, pipeline, w.Code)
+		}
+	}
+
+	if len(stored) != 2 || len(mockOutbox.dispatched) != 2 {
+		t.Fatalf("Expected 2 webhooks stored and dispatched, got %d and %v", len(stored), mockOutbox.dispatched)
+	}
+	for _, id := range mockOutbox.dispatched {
+		doc := stored[id]
+		if doc == nil {
+			t.Fatalf("Expected %s to be stored", id)
+		}
+		if len(doc.Workflows) != 1 || doc.Workflows[0].Pipeline != doc.Pipeline {
+			t.Errorf("Expected 1 workflow for %s, got %+v", doc.Pipeline, doc.Workflows)
+		}
+	}
+}
+
+func TestHandleWebhook_RecordsMessageProperties(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	orgs := map[string]config.Organisation{
+		"test": {
+			Pipelines: map[string]config.Pipeline{
+				"build": {Priority: 5, Expiration: time.Minute},
+			},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		requestID     string
+		correlationID string
+	}{
+		{"Request ID", "req-1234", "req-1234"},
+		{"Delivery ID", "", "72d3162e-cc78-11e3-81ab-4c9367dc0958"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stored *models.WebhookDoc
+			mockStorage := &MockStorage{
+				storeWebhookFunc: func(doc *models.WebhookDoc) error {
+					stored = doc
+					return nil
+				},
+			}
+			handler := NewWebhookHandler(mockStorage, &MockOutbox{}, providers.Default(), orgs)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/webhooks/test/build", bytes.NewBufferString(pushBody))
+			if tt.requestID != "" {
+				c.Request.Header.Set("X-Request-Id", tt.requestID)
+			}
+			c.Params = gin.Params{{Key: "organisation", Value: "test"}, {Key: "pipeline", Value: "build"}}
+			c.Set("raw_body", []byte(pushBody))
+			c.Set("delivery_id", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+
+			handler.HandleWebhook(c)
+
+			if stored.CorrelationID != tt.correlationID {
+				t.Errorf("Expected correlation ID %s, got %s", tt.correlationID, stored.CorrelationID)
+			}
+			if stored.Priority != 5 || stored.Expiration != "60000" {
+				t.Errorf("Expected priority 5 and expiration 60000, got %d %s", stored.Priority, stored.Expiration)
+			}
+		})
+	}
+}
+
+func TestHandleWebhook_RecordsDeliveryMetadata(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var stored *models.WebhookDoc
+	mockStorage := &MockStorage{
+		storeWebhookFunc: func(doc *models.WebhookDoc) error {
+			stored = doc
+			return nil
+		},
+	}
+	handler := NewWebhookHandler(mockStorage, &MockOutbox{}, providers.Default(), nil)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/webhooks/test/build", bytes.NewBufferString(pushBody))
+	c.Params = gin.Params{{Key: "organisation", Value: "test"}, {Key: "pipeline", Value: "build"}}
+	c.Set("raw_body", []byte(pushBody))
+	c.Set("secret_id", "2024-q3")
+	c.Set("provider", "github")
+
+	handler.HandleWebhook(c)
+
+	if stored == nil {
+		t.Fatal("Expected webhook to be stored")
+	}
+	if stored.SecretID != "2024-q3" {
+		t.Errorf("Expected secret_id 2024-q3, got %s", stored.SecretID)
+	}
+	if stored.Provider != "github" {
+		t.Errorf("Expected provider github, got %s", stored.Provider)
+	}
+	if stored.Organisation != "test" || stored.Pipeline != "build" {
+		t.Errorf("Expected test/build, got %s/%s", stored.Organisation, stored.Pipeline)
+	}
+
+	if len(stored.Workflows) != 1 {
+		t.Fatalf("Expected 1 workflow to be stored, got %d", len(stored.Workflows))
+	}
+	if stored.Workflows[0].Pipeline != "build" {
+		t.Errorf("Expected workflow pipeline build, got %s", stored.Workflows[0].Pipeline)
+	}
+}
+
+func TestHandleWebhook_PublishesEveryRef(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	body, err := os.ReadFile("../../testdata/webhook_bitbucket_datacenter_refs_changed.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stored *models.WebhookDoc
+	mockStorage := &MockStorage{
+		storeWebhookFunc: func(doc *models.WebhookDoc) error {
+			stored = doc
+			return nil
+		},
+	}
+	handler := NewWebhookHandler(mockStorage, &MockOutbox{}, providers.Default(), nil)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/webhooks/test", bytes.NewBuffer(body))
+	c.Request.Header.Set("X-Event-Key", "repo:refs_changed")
+	c.Set("raw_body", body)
+
+	handler.HandleWebhook(c)
+
+	if w.Code != http.StatusAccepted {
+		t.Errorf("Expected status %d, got %d", http.StatusAccepted, w.Code)
+	}
+	if len(stored.Workflows) != 3 {
+		t.Errorf("Expected 3 workflows to publish, got %d", len(stored.Workflows))
+	}
+}
+
+func TestHandleWebhook_StoresTransformError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	orgs := map[string]config.Organisation{
+		"tools": {
+			Providers: []string{"mapping"},
+			Mapping:   &config.Mapping{Ref: "$.build.commit", URL: "$.build.repo", Org: "tools"},
+		},
+	}
+	mappings, err := providers.NewMapping(orgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := providers.Default()
+	registry.Register(mappings)
+
+	var stored *models.WebhookDoc
+	mockStorage := &MockStorage{
+		storeWebhookFunc: func(doc *models.WebhookDoc) error {
+			stored = doc
+			return nil
+		},
+	}
+	handler := NewWebhookHandler(mockStorage, &MockOutbox{}, registry, orgs)
+
+	body := `{"build": {"repo": "git@git.example:tools/widget.git"}}`
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/webhooks/tools", bytes.NewBufferString(body))
+	c.Params = gin.Params{{Key: "organisation", Value: "tools"}}
+	c.Set("raw_body", []byte(body))
+	c.Set("provider", "mapping")
+
+	handler.HandleWebhook(c)
+
+	expected := `ref "$.build.commit": $.build.commit not found`
+	if stored == nil {
+		t.Fatal("Expected webhook to be stored")
+	}
+	if stored.TransformError != expected {
+		t.Errorf("Expected stored transform error '%s', got '%s'", expected, stored.TransformError)
+	}
+
+	var response map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response["transform_error"] != expected {
+		t.Errorf("Expected transform_error '%s', got '%s'", expected, response["transform_error"])
+	}
+}
+
+func TestHandleWebhook_Ping(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stored := false
+	mockStorage := &MockStorage{
+		storeWebhookFunc: func(doc *models.WebhookDoc) error {
+			stored = true
+			return nil
+		},
+	}
+	handler := NewWebhookHandler(mockStorage, &MockOutbox{}, providers.Default(), nil)
+
+	body := `{"zen": "Design for failure.", "hook_id": 12345678}`
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/webhooks/test", bytes.NewBufferString(body))
+	c.Request.Header.Set("X-GitHub-Event", "ping")
+	c.Set("raw_body", []byte(body))
+
+	handler.HandleWebhook(c)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if stored {
+		t.Error("Expected ping not to be stored")
+	}
+
+	var response map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response["message"] != "pong" {
+		t.Errorf("Expected pong, got %v", response)
+	}
+}
+
+func TestHandleWebhook_Events(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	orgs := map[string]config.Organisation{
+		"test": {
+			Pipelines: map[string]config.Pipeline{
+				"build":    {},
+				"releases": {Events: []string{"pull_request"}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		event          string
+		pipeline       string
+		expectedStatus int
+		published      bool
+	}{
+		{"Push", "push", "build", http.StatusAccepted, true},
+		{"Unsupported event", "release", "build", http.StatusAccepted, false},
+		{"Event not listed for pipeline", "push", "releases", http.StatusAccepted, false},
+		{"Pull request not listed", "pull_request", "build", http.StatusAccepted, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stored *models.WebhookDoc
+			mockStorage := &MockStorage{
+				storeWebhookFunc: func(doc *models.WebhookDoc) error {
+					stored = doc
+					return nil
+				},
+			}
+			handler := NewWebhookHandler(mockStorage, &MockOutbox{}, providers.Default(), orgs)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/webhooks/test/"+tt.pipeline, bytes.NewBufferString(pushBody))
+			c.Request.Header.Set("X-GitHub-Event", tt.event)
+			c.Params = gin.Params{{Key: "organisation", Value: "test"}, {Key: "pipeline", Value: tt.pipeline}}
+			c.Set("raw_body", []byte(pushBody))
+
+			handler.HandleWebhook(c)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if stored == nil {
+				t.Fatal("Expected webhook to be stored")
+			}
+			if stored.Event != tt.event {
+				t.Errorf("Expected stored event %s, got %s", tt.event, stored.Event)
+			}
+			if (len(stored.Workflows) > 0) != tt.published {
+				t.Errorf("Expected published %v, got %+v", tt.published, stored.Workflows)
+			}
+			if len(stored.Workflows) > 0 && stored.Workflows[0].Event != tt.event {
+				t.Errorf("Expected workflow event %s, got %s", tt.event, stored.Workflows[0].Event)
+			}
+		})
+	}
+}
+
+func TestHandleWebhook_RefRules(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	body, err := os.ReadFile("../../testdata/webhook_bitbucket_datacenter_refs_changed.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orgs := map[string]config.Organisation{
+		"test": {
+			Pipelines: map[string]config.Pipeline{
+				"main":     {Refs: config.RefRules{Include: []string{"refs/heads/main"}}},
+				"releases": {Refs: config.RefRules{Include: []string{"refs/tags/**"}}},
+				"builds":   {Deletions: "skip"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		pipeline       string
+		expectedStatus int
+		published      []string
+		skipReason     string
+	}{
+		{"Unfiltered", "", http.StatusAccepted, []string{"refs/heads/main", "refs/heads/release", "refs/heads/feature/old"}, ""},
+		{"Some refs selected", "main", http.StatusAccepted, []string{"refs/heads/main"}, ""},
+		{"Deletions skipped", "builds", http.StatusAccepted, []string{"refs/heads/main", "refs/heads/release"}, ""},
+		{"No ref selected", "releases", http.StatusAccepted, nil, "refs/heads/main not selected; refs/heads/release not selected; refs/heads/feature/old not selected"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stored *models.WebhookDoc
+			mockStorage := &MockStorage{
+				storeWebhookFunc: func(doc *models.WebhookDoc) error {
+					stored = doc
+					return nil
+				},
+			}
+			handler := NewWebhookHandler(mockStorage, &MockOutbox{}, providers.Default(), orgs)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/webhooks/test", bytes.NewBuffer(body))
+			c.Request.Header.Set("X-Event-Key", "repo:refs_changed")
+			c.Params = gin.Params{{Key: "organisation", Value: "test"}, {Key: "pipeline", Value: tt.pipeline}}
+			c.Set("raw_body", body)
+
+			handler.HandleWebhook(c)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if stored == nil {
+				t.Fatal("Expected webhook to be stored")
+			}
+			var published []string
+			for _, workflow := range stored.Workflows {
+				published = append(published, workflow.RefName)
+			}
+			if strings.Join(published, " ") != strings.Join(tt.published, " ") {
+				t.Errorf("Expected %v published, got %v", tt.published, published)
+			}
+			if tt.skipReason == "" && stored.Status != "" {
+				t.Errorf("Expected no status, got %s", stored.Status)
+			}
+			if tt.skipReason != "" && (stored.Status != models.StatusSkipped || stored.SkipReason != tt.skipReason) {
+				t.Errorf("Expected skipped with '%s', got %s '%s'", tt.skipReason, stored.Status, stored.SkipReason)
+			}
+		})
+	}
+}
+
+func TestHandleWebhook_SkipsDeletions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	body, err := os.ReadFile("../../testdata/webhook_github_delete.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orgs := map[string]config.Organisation{"test": {Deletions: "skip"}}
+
+	var stored *models.WebhookDoc
+	mockStorage := &MockStorage{
+		storeWebhookFunc: func(doc *models.WebhookDoc) error {
+			stored = doc
+			return nil
+		},
+	}
+	handler := NewWebhookHandler(mockStorage, &MockOutbox{}, providers.Default(), orgs)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/webhooks/test", bytes.NewBuffer(body))
+	c.Request.Header.Set("X-GitHub-Event", "push")
+	c.Params = gin.Params{{Key: "organisation", Value: "test"}}
+	c.Set("raw_body", body)
+
+	handler.HandleWebhook(c)
+
+	if w.Code != http.StatusAccepted {
+		t.Errorf("Expected status %d, got %d", http.StatusAccepted, w.Code)
+	}
+	if stored == nil {
+		t.Fatal("Expected webhook to be stored")
+	}
+	if stored.Status != models.StatusSkipped || stored.SkipReason != "refs/heads/feature/old deleted" {
+		t.Errorf("Expected skipped deletion, got %s '%s'", stored.Status, stored.SkipReason)
+	}
+}
+
+func TestHandleWebhook_SkipMarkers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	body, err := os.ReadFile("../../testdata/webhook_github.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = bytes.ReplaceAll(body, []byte(`"Update README.md"`), []byte(`"Update README.md [Skip CI]"`))
+
+	orgs := map[string]config.Organisation{
+		"test": {
+			Skip: config.SkipRules{Markers: []string{"[skip ci]", "[ci skip]"}},
+			Pipelines: map[string]config.Pipeline{
+				"docs":    {},
+				"deploy":  {Skip: &config.SkipRules{Markers: []string{"[skip deploy]"}}},
+				"release": {Skip: &config.SkipRules{}},
+			},
+		},
+	}
+
+	tests := []struct {
+		pipeline       string
+		expectedStatus int
+		published      bool
+		marker         string
+	}{
+		{"docs", http.StatusAccepted, false, "[skip ci]"},
+		{"deploy", http.StatusAccepted, true, ""},
+		{"release", http.StatusAccepted, true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pipeline, func(t *testing.T) {
+			var stored *models.WebhookDoc
+			mockStorage := &MockStorage{
+				storeWebhookFunc: func(doc *models.WebhookDoc) error {
+					stored = doc
+					return nil
+				},
+			}
+			handler := NewWebhookHandler(mockStorage, &MockOutbox{}, providers.Default(), orgs)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/webhooks/test/"+tt.pipeline, bytes.NewBuffer(body))
+			c.Request.Header.Set("X-GitHub-Event", "push")
+			c.Params = gin.Params{{Key: "organisation", Value: "test"}, {Key: "pipeline", Value: tt.pipeline}}
+			c.Set("raw_body", body)
+
+			handler.HandleWebhook(c)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if published := len(stored.Workflows) > 0; published != tt.published {
+				t.Errorf("Expected published %v, got %v", tt.published, published)
+			}
+			if stored.SkipMarker != tt.marker {
+				t.Errorf("Expected skip marker '%s', got '%s'", tt.marker, stored.SkipMarker)
+			}
+			if tt.marker != "" && stored.SkipReason != `refs/heads/master skipped by "[skip ci]"` {
+				t.Errorf("Expected skip reason naming the marker, got '%s'", stored.SkipReason)
+			}
+		})
+	}
+}
+
+func TestHandleWebhook_PathRules(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	body, err := os.ReadFile("../../testdata/webhook_github.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orgs := map[string]config.Organisation{
+		"mono": {
+			Pipelines: map[string]config.Pipeline{
+				"docs": {Paths: config.PathRules{Include: []string{"**/*.md"}, Publish: true}},
+				"site": {Paths: config.PathRules{Include: []string{"**/*.md"}}},
+				"api":  {Paths: config.PathRules{Include: []string{"services/api/**"}}},
+			},
+		},
+	}
+
+	tests := []struct {
+		pipeline       string
+		expectedStatus int
+		published      bool
+		paths          []string
+		skipReason     string
+	}{
+		{"docs", http.StatusAccepted, true, []string{"README.md"}, ""},
+		{"site", http.StatusAccepted, true, nil, ""},
+		{"api", http.StatusAccepted, false, nil, "no selected path changed in refs/heads/master"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pipeline, func(t *testing.T) {
+			var stored *models.WebhookDoc
+			mockStorage := &MockStorage{
+				storeWebhookFunc: func(doc *models.WebhookDoc) error {
+					stored = doc
+					return nil
+				},
+			}
+			handler := NewWebhookHandler(mockStorage, &MockOutbox{}, providers.Default(), orgs)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/webhooks/mono/"+tt.pipeline, bytes.NewBuffer(body))
+			c.Request.Header.Set("X-GitHub-Event", "push")
+			c.Params = gin.Params{{Key: "organisation", Value: "mono"}, {Key: "pipeline", Value: tt.pipeline}}
+			c.Set("raw_body", body)
+
+			handler.HandleWebhook(c)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			var published *models.Workflow
+			if len(stored.Workflows) > 0 {
+				published = stored.Workflows[0]
+			}
+			if (published != nil) != tt.published {
+				t.Fatalf("Expected published %v, got %+v", tt.published, published)
+			}
+			if published != nil && strings.Join(published.Paths, " ") != strings.Join(tt.paths, " ") {
+				t.Errorf("Expected paths %v, got %v", tt.paths, published.Paths)
+			}
+			if stored.SkipReason != tt.skipReason {
+				t.Errorf("Expected skip reason '%s', got '%s'", tt.skipReason, stored.SkipReason)
+			}
+		})
+	}
+}
+
+func TestHandleWebhook_InvalidJSON(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	handler := NewWebhookHandler(&MockStorage{}, &MockOutbox{}, providers.Default(), nil)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/webhooks/test", bytes.NewBufferString("not json"))
+	c.Set("raw_body", []byte("not json"))
+
+	handler.HandleWebhook(c)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,168 @@
+package ipset
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Set is an immutable set of IP prefixes stored as a binary trie, so a
+// lookup costs at most one step per address bit regardless of size.
+// IPv4-mapped IPv6 addresses and prefixes are treated as IPv4.
+type Set struct {
+	v4  *node
+	v6  *node
+	len int
+}
+
+type node struct {
+	child [2]*node
+
+	// entry is the configured text of the prefix ending at this node,
+	// kept so that matches can be reported as written.
+	entry string
+}
+
+// ParsePrefix accepts a single address or a CIDR range and returns it
+// as a normalised, masked prefix.
+func ParsePrefix(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+
+	var prefix netip.Prefix
+	if strings.Contains(entry, "/") {
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		prefix = p
+	} else {
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.WithZone("")
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+
+	if addr := prefix.Addr(); addr.Is4In6() {
+		if prefix.Bits() < 96 {
+			return netip.Prefix{}, fmt.Errorf("%s: mapped IPv4 prefix shorter than /96", entry)
+		}
+		prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+	}
+
+	return prefix.Masked(), nil
+}
+
+// Parse builds a set from addresses and CIDR ranges, rejecting the
+// whole list if any entry is invalid.
+func Parse(entries []string) (*Set, error) {
+	s := &Set{}
+	for _, entry := range entries {
+		prefix, err := ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip or cidr %q: %w", entry, err)
+		}
+		s.insert(prefix, strings.TrimSpace(entry))
+	}
+	return s, nil
+}
+
+// MustParse is like Parse but panics on invalid entries. It is meant for
+// lists already checked by config validation.
+func MustParse(entries []string) *Set {
+	s, err := Parse(entries)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// ParseAddr parses a client address, normalising IPv4-mapped IPv6 to
+// IPv4 and dropping any zone.
+func ParseAddr(ip string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap().WithZone(""), nil
+}
+
+// Len returns the number of distinct prefixes in the set.
+func (s *Set) Len() int {
+	if s == nil {
+		return 0
+	}
+	return s.len
+}
+
+// Contains reports whether any prefix in the set contains addr.
+func (s *Set) Contains(addr netip.Addr) bool {
+	_, ok := s.Lookup(addr)
+	return ok
+}
+
+// Lookup returns the configured entry of the shortest prefix containing
+// addr.
+func (s *Set) Lookup(addr netip.Addr) (string, bool) {
+	if s == nil || !addr.IsValid() {
+		return "", false
+	}
+
+	addr = addr.Unmap()
+	n := s.v6
+	if addr.Is4() {
+		n = s.v4
+	}
+
+	bits := addrBits(addr)
+	for i := 0; n != nil; i++ {
+		if n.entry != "" {
+			return n.entry, true
+		}
+		if i == addr.BitLen() {
+			break
+		}
+		n = n.child[bit(bits, i)]
+	}
+	return "", false
+}
+
+func (s *Set) insert(prefix netip.Prefix, entry string) {
+	root := &s.v6
+	if prefix.Addr().Is4() {
+		root = &s.v4
+	}
+	if *root == nil {
+		*root = &node{}
+	}
+
+	n := *root
+	bits := addrBits(prefix.Addr())
+	for i := 0; i < prefix.Bits(); i++ {
+		b := bit(bits, i)
+		if n.child[b] == nil {
+			n.child[b] = &node{}
+		}
+		n = n.child[b]
+	}
+
+	if n.entry == "" {
+		n.entry = entry
+		s.len++
+	}
+}
+
+func addrBits(addr netip.Addr) [16]byte {
+	if addr.Is4() {
+		var bits [16]byte
+		a4 := addr.As4()
+		copy(bits[:], a4[:])
+		return bits
+	}
+	return addr.As16()
+}
+
+func bit(bits [16]byte, i int) int {
+	return int(bits[i/8]>>(7-uint(i%8))) & 1
+}
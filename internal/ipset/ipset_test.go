@@ -0,0 +1,133 @@
+package ipset
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+func TestSet_Contains(t *testing.T) {
+	set := MustParse([]string{
+		"192.168.1.100",
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"::1",
+		"2001:db8::/32",
+		"::ffff:198.51.100.0/120",
+	})
+
+	tests := []struct {
+		name     string
+		clientIP string
+		expected bool
+	}{
+		{"Exact match IPv4", "192.168.1.100", true},
+		{"CIDR match 10.x", "10.1.2.3", true},
+		{"CIDR match 172.16.x", "172.16.1.1", true},
+		{"CIDR no match", "172.15.1.1", false},
+		{"No match", "1.2.3.4", false},
+		{"IPv6 exact", "::1", true},
+		{"IPv6 exact, long form", "0:0:0:0:0:0:0:1", true},
+		{"IPv6 CIDR match", "2001:db8::1", true},
+		{"IPv6 CIDR match, leading zeros", "2001:0db8:0000::0001", true},
+		{"IPv6 no match", "2001:db9::1", false},
+		{"IPv4-mapped client", "::ffff:192.168.1.100", true},
+		{"IPv4-mapped client in range", "::ffff:10.9.8.7", true},
+		{"IPv4-mapped entry", "198.51.100.7", true},
+		{"IPv6 zone", "fe80::1%eth0", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := ParseAddr(tt.clientIP)
+			if err != nil {
+				t.Fatalf("Expected %s to parse, got %v", tt.clientIP, err)
+			}
+			if result := set.Contains(addr); result != tt.expected {
+				t.Errorf("Expected %v for IP %s, got %v", tt.expected, tt.clientIP, result)
+			}
+		})
+	}
+
+	if set.Contains(netip.Addr{}) {
+		t.Error("Expected invalid address not to match")
+	}
+}
+
+func TestSet_Lookup(t *testing.T) {
+	set := MustParse([]string{"10.0.0.0/8", "10.1.0.0/16", " 192.0.2.1 "})
+
+	entry, ok := set.Lookup(netip.MustParseAddr("10.1.2.3"))
+	if !ok || entry != "10.0.0.0/8" {
+		t.Errorf("Expected shortest prefix 10.0.0.0/8, got '%s'", entry)
+	}
+
+	entry, ok = set.Lookup(netip.MustParseAddr("192.0.2.1"))
+	if !ok || entry != "192.0.2.1" {
+		t.Errorf("Expected entry as configured, got '%s'", entry)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, entry := range []string{"invalid", "10.0.0.0/33", "10.0.0.1/", "::ffff:0:0/64", ""} {
+		if _, err := Parse([]string{"10.0.0.0/8", entry}); err == nil {
+			t.Errorf("Expected error for entry %q", entry)
+		}
+	}
+}
+
+func TestParse_Normalises(t *testing.T) {
+	set := MustParse([]string{"10.1.2.3/8", "10.0.0.0/8", "::ffff:10.0.0.0/104"})
+
+	if set.Len() != 1 {
+		t.Errorf("Expected equivalent prefixes to collapse into one, got %d", set.Len())
+	}
+}
+
+func TestSet_Nil(t *testing.T) {
+	var set *Set
+
+	if set.Len() != 0 {
+		t.Error("Expected nil set to be empty")
+	}
+	if set.Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Error("Expected nil set to contain nothing")
+	}
+}
+
+// generatePrefixes returns n distinct /24 ranges in 10.0.0.0/8 and n
+// distinct /48 ranges in 2001:db8::/32.
+func generatePrefixes(n int) []string {
+	entries := make([]string, 0, 2*n)
+	for i := 0; i < n; i++ {
+		entries = append(entries, fmt.Sprintf("10.%d.%d.0/24", (i>>8)&0xff, i&0xff))
+		entries = append(entries, fmt.Sprintf("2001:db8:%x::/48", i))
+	}
+	return entries
+}
+
+func BenchmarkSet_Contains(b *testing.B) {
+	miss4 := netip.MustParseAddr("192.0.2.1")
+	hit6 := netip.MustParseAddr("2001:db8:7::1")
+
+	for _, n := range []int{10, 100, 1000, 10000} {
+		set := MustParse(generatePrefixes(n))
+		hit4 := netip.MustParseAddr(fmt.Sprintf("10.%d.%d.1", ((n-1)>>8)&0xff, (n-1)&0xff))
+
+		b.Run(fmt.Sprintf("%d/hit4", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				set.Contains(hit4)
+			}
+		})
+		b.Run(fmt.Sprintf("%d/miss4", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				set.Contains(miss4)
+			}
+		})
+		b.Run(fmt.Sprintf("%d/hit6", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				set.Contains(hit6)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package ipsource
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"tsuribari/internal/config"
+	"tsuribari/internal/ipset"
+)
+
+const defaultRefresh = time.Hour
+
+// Meta fetches a JSON document of CIDRs, in the style of GitHub's
+// https://api.github.com/meta, and keeps the last good set in memory and
+// on disk.
+type Meta struct {
+	name      string
+	url       string
+	keys      []string
+	cachePath string
+	refresh   time.Duration
+	client    *http.Client
+
+	set atomic.Pointer[ipset.Set]
+}
+
+func NewMeta(source config.IPSource) *Meta {
+	refresh := source.Refresh
+	if refresh <= 0 {
+		refresh = defaultRefresh
+	}
+
+	return &Meta{
+		name:      source.Name,
+		url:       source.URL,
+		keys:      source.Keys,
+		cachePath: source.Cache,
+		refresh:   refresh,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Set returns the current set of CIDRs, compiled once per refresh.
+func (m *Meta) Set() *ipset.Set {
+	return m.set.Load()
+}
+
+// LoadCache seeds the set from the cache file, if there is one.
+func (m *Meta) LoadCache() error {
+	if m.cachePath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(m.cachePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	set, err := m.parse(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", m.cachePath, err)
+	}
+
+	m.set.Store(set)
+	return nil
+}
+
+// Refresh fetches the document and replaces the set. On failure the
+// previous set is kept.
+func (m *Meta) Refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	set, err := m.parse(data)
+	if err != nil {
+		return err
+	}
+
+	m.set.Store(set)
+
+	if m.cachePath != "" {
+		if err := writeFileAtomic(m.cachePath, data); err != nil {
+			log.Printf("WARN: ip source %s: cannot write cache: %v", m.name, err)
+		}
+	}
+	return nil
+}
+
+// Run refreshes the set immediately and then on every interval until the
+// context is cancelled.
+func (m *Meta) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.refresh)
+	defer ticker.Stop()
+
+	for {
+		if err := m.Refresh(ctx); err != nil {
+			log.Printf("WARN: ip source %s: refresh failed, keeping %d prefixes: %v", m.name, m.Set().Len(), err)
+		} else {
+			log.Printf("INFO: ip source %s: loaded %d prefixes", m.name, m.Set().Len())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// parse extracts the CIDRs under the configured keys. A document with
+// any invalid entry is rejected as a whole.
+func (m *Meta) parse(data []byte) (*ipset.Set, error) {
+	var lists [][]string
+
+	if len(m.keys) == 0 {
+		var list []string
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	} else {
+		var doc map[string]json.RawMessage
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		for _, key := range m.keys {
+			raw, ok := doc[key]
+			if !ok {
+				return nil, fmt.Errorf("missing key %q", key)
+			}
+			var list []string
+			if err := json.Unmarshal(raw, &list); err != nil {
+				return nil, fmt.Errorf("key %q: %w", key, err)
+			}
+			lists = append(lists, list)
+		}
+	}
+
+	var prefixes []string
+	for _, list := range lists {
+		prefixes = append(prefixes, list...)
+	}
+
+	set, err := ipset.Parse(prefixes)
+	if err != nil {
+		return nil, err
+	}
+	if set.Len() == 0 {
+		return nil, fmt.Errorf("no prefixes found")
+	}
+	return set, nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
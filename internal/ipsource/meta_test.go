@@ -0,0 +1,115 @@
+package ipsource
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tsuribari/internal/config"
+)
+
+const metaDoc = `{
+  "verifiable_password_authentication": false,
+  "hooks": ["192.30.252.0/22", "185.199.108.0/22", "2a0a:a440::/29"],
+  "web": ["140.82.112.0/20"]
+}`
+
+func TestMeta_Refresh(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(metaDoc))
+	}))
+	defer server.Close()
+
+	cache := filepath.Join(t.TempDir(), "meta.json")
+	meta := NewMeta(config.IPSource{
+		Name:  "github",
+		Type:  "github-meta",
+		URL:   server.URL,
+		Keys:  []string{"hooks"},
+		Cache: cache,
+	})
+
+	if err := meta.Refresh(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	set := meta.Set()
+	if set.Len() != 3 {
+		t.Fatalf("Expected 3 prefixes, got %d", set.Len())
+	}
+	if !set.Contains(netip.MustParseAddr("192.30.253.1")) {
+		t.Error("Expected 192.30.253.1 to be in the hooks range")
+	}
+	if set.Contains(netip.MustParseAddr("140.82.112.1")) {
+		t.Error("Expected web range not to be included")
+	}
+
+	data, err := os.ReadFile(cache)
+	if err != nil {
+		t.Fatalf("Expected cache file to be written, got %v", err)
+	}
+	if string(data) != metaDoc {
+		t.Error("Expected cache file to hold the fetched document")
+	}
+}
+
+func TestMeta_RefreshFailureKeepsLastGoodSet(t *testing.T) {
+	responses := []struct {
+		status int
+		body   string
+	}{
+		{http.StatusOK, metaDoc},
+		{http.StatusInternalServerError, ""},
+		{http.StatusOK, `{"hooks": ["not-a-cidr"]}`},
+		{http.StatusOK, `{"web": ["140.82.112.0/20"]}`},
+	}
+	call := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := responses[call]
+		call++
+		w.WriteHeader(resp.status)
+		w.Write([]byte(resp.body))
+	}))
+	defer server.Close()
+
+	meta := NewMeta(config.IPSource{Name: "github", URL: server.URL, Keys: []string{"hooks"}})
+
+	if err := meta.Refresh(context.Background()); err != nil {
+		t.Fatalf("Expected first refresh to succeed, got %v", err)
+	}
+
+	for i := 1; i < len(responses); i++ {
+		if err := meta.Refresh(context.Background()); err == nil {
+			t.Errorf("Expected refresh %d to fail", i)
+		}
+		if meta.Set().Len() != 3 {
+			t.Errorf("Expected last good set to be kept after refresh %d, got %d prefixes", i, meta.Set().Len())
+		}
+	}
+}
+
+func TestMeta_LoadCache(t *testing.T) {
+	cache := filepath.Join(t.TempDir(), "meta.json")
+
+	meta := NewMeta(config.IPSource{Name: "mirror", Cache: cache})
+	if err := meta.LoadCache(); err != nil {
+		t.Fatalf("Expected missing cache to be ignored, got %v", err)
+	}
+	if meta.Set().Len() != 0 {
+		t.Error("Expected no prefixes without cache")
+	}
+
+	if err := os.WriteFile(cache, []byte(`["10.0.0.0/8", "192.0.2.1"]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.LoadCache(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if meta.Set().Len() != 2 {
+		t.Errorf("Expected 2 prefixes from plain array cache, got %d", meta.Set().Len())
+	}
+}
@@ -0,0 +1,176 @@
+package mapping
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"tsuribari/internal/models"
+)
+
+// Expression yields a string from a webhook document. It is either a
+// single reference, such as `$.head_commit.id` or `$header.X-Event`, or
+// a template in which references appear inside `{{ }}`, such as
+// `git@git.example:{{ $.repository.name }}.git`. Body references may
+// index arrays, as in `$.commits[0].id`.
+type Expression struct {
+	raw   string
+	parts []part
+}
+
+// part is either literal text or a reference to a body path or header.
+type part struct {
+	literal string
+	path    []step
+	header  string
+}
+
+// step is one field name, or an array index when field is empty.
+type step struct {
+	field string
+	index int
+}
+
+// ParseExpression compiles an expression.
+func ParseExpression(raw string) (*Expression, error) {
+	e := &Expression{raw: raw}
+
+	if strings.HasPrefix(strings.TrimSpace(raw), "$") && !strings.Contains(raw, "{{") {
+		p, err := parseReference(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, err
+		}
+		e.parts = []part{p}
+		return e, nil
+	}
+
+	rest := raw
+	for rest != "" {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			e.parts = append(e.parts, part{literal: rest})
+			break
+		}
+		if start > 0 {
+			e.parts = append(e.parts, part{literal: rest[:start]})
+		}
+
+		end := strings.Index(rest[start:], "}}")
+		if end < 0 {
+			return nil, errors.New("unterminated {{")
+		}
+		p, err := parseReference(strings.TrimSpace(rest[start+2 : start+end]))
+		if err != nil {
+			return nil, err
+		}
+		e.parts = append(e.parts, p)
+		rest = rest[start+end+2:]
+	}
+	return e, nil
+}
+
+func (e *Expression) String() string {
+	return e.raw
+}
+
+// Eval returns the value of the expression. Every reference must resolve
+// to a string, number or boolean.
+func (e *Expression) Eval(doc *models.WebhookDoc) (string, error) {
+	var b strings.Builder
+	for _, p := range e.parts {
+		switch {
+		case p.header != "":
+			value, ok := doc.Headers[p.header]
+			if !ok {
+				return "", fmt.Errorf("no header %s", p.header)
+			}
+			b.WriteString(value)
+		case p.path != nil:
+			value, err := lookup(doc.Body, p.path)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+		default:
+			b.WriteString(p.literal)
+		}
+	}
+	return b.String(), nil
+}
+
+func parseReference(ref string) (part, error) {
+	if name, ok := strings.CutPrefix(ref, "$header."); ok {
+		if name == "" {
+			return part{}, errors.New("empty header name")
+		}
+		return part{header: http.CanonicalHeaderKey(name)}, nil
+	}
+
+	path, ok := strings.CutPrefix(ref, "$.")
+	if !ok {
+		return part{}, fmt.Errorf("%q is not a $. path or $header. reference", ref)
+	}
+
+	var steps []step
+	for _, segment := range strings.Split(path, ".") {
+		field, indexes, _ := strings.Cut(segment, "[")
+		if field == "" && indexes == "" {
+			return part{}, fmt.Errorf("empty segment in %q", ref)
+		}
+		if field != "" {
+			steps = append(steps, step{field: field})
+		}
+		if indexes == "" {
+			continue
+		}
+
+		for _, index := range strings.Split(strings.TrimSuffix(indexes, "]"), "][") {
+			n, err := strconv.Atoi(index)
+			if err != nil || n < 0 {
+				return part{}, fmt.Errorf("invalid index [%s] in %q", index, ref)
+			}
+			steps = append(steps, step{index: n})
+		}
+	}
+	return part{path: steps}, nil
+}
+
+func lookup(body map[string]interface{}, path []step) (string, error) {
+	var value interface{} = body
+	walked := "$"
+
+	for _, s := range path {
+		if s.field != "" {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return "", fmt.Errorf("%s is not an object", walked)
+			}
+			walked += "." + s.field
+			if value, ok = object[s.field]; !ok {
+				return "", fmt.Errorf("%s not found", walked)
+			}
+			continue
+		}
+
+		walked += "[" + strconv.Itoa(s.index) + "]"
+		array, ok := value.([]interface{})
+		if !ok || s.index >= len(array) {
+			return "", fmt.Errorf("%s not found", walked)
+		}
+		value = array[s.index]
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", fmt.Errorf("%s is null", walked)
+	}
+	return "", fmt.Errorf("%s is not a string, number or boolean", walked)
+}
@@ -0,0 +1,107 @@
+package mapping
+
+import (
+	"testing"
+
+	"tsuribari/internal/models"
+)
+
+func testDoc() *models.WebhookDoc {
+	return &models.WebhookDoc{
+		ID:      "test-doc-id",
+		Headers: map[string]string{"X-Tool-Event": "build"},
+		Body: map[string]interface{}{
+			"build": map[string]interface{}{
+				"commit": "abc123def456789",
+				"repo":   "tools/widget",
+				"branch": "main",
+				"number": float64(42),
+				"manual": false,
+				"parent": nil,
+			},
+			"events": []interface{}{
+				map[string]interface{}{
+					"target": map[string]interface{}{"digest": "sha256:0f1e2d"},
+				},
+			},
+		},
+	}
+}
+
+func TestExpression_Eval(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{"Path", "$.build.commit", "abc123def456789"},
+		{"Array index", "$.events[0].target.digest", "sha256:0f1e2d"},
+		{"Number", "$.build.number", "42"},
+		{"Boolean", "$.build.manual", "false"},
+		{"Header", "$header.x-tool-event", "build"},
+		{"Template", "git@git.example:{{ $.build.repo }}.git", "git@git.example:tools/widget.git"},
+		{"Template with header", "{{$header.X-Tool-Event}}-{{ $.build.number }}", "build-42"},
+		{"Literal", "tools", "tools"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := ParseExpression(tt.raw)
+			if err != nil {
+				t.Fatalf("Expected %q to parse, got %v", tt.raw, err)
+			}
+
+			value, err := e.Eval(testDoc())
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if value != tt.expected {
+				t.Errorf("Expected '%s', got '%s'", tt.expected, value)
+			}
+		})
+	}
+}
+
+func TestExpression_EvalErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{"Missing field", "$.build.tag", "$.build.tag not found"},
+		{"Missing index", "$.events[3].target", "$.events[3] not found"},
+		{"Not an object", "$.build.commit.id", "$.build.commit is not an object"},
+		{"Null", "$.build.parent", "$.build.parent is null"},
+		{"Object", "$.build", "$.build is not a string, number or boolean"},
+		{"Missing header", "$header.X-Missing", "no header X-Missing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := ParseExpression(tt.raw)
+			if err != nil {
+				t.Fatalf("Expected %q to parse, got %v", tt.raw, err)
+			}
+
+			_, err = e.Eval(testDoc())
+			if err == nil || err.Error() != tt.expected {
+				t.Errorf("Expected error '%s', got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestParseExpression_Invalid(t *testing.T) {
+	for _, raw := range []string{
+		"$build.commit",
+		"$.build..commit",
+		"$.events[x]",
+		"git@{{ $.build.repo .git",
+		"{{ build.repo }}",
+		"$header.",
+	} {
+		if _, err := ParseExpression(raw); err == nil {
+			t.Errorf("Expected %q to be rejected", raw)
+		}
+	}
+}
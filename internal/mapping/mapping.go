@@ -0,0 +1,132 @@
+package mapping
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"tsuribari/internal/config"
+	"tsuribari/internal/models"
+)
+
+// Mapping is a compiled config.Mapping.
+type Mapping struct {
+	ref     *Expression
+	refName *Expression
+	url     *Expression
+	org     *Expression
+	match   []condition
+}
+
+type condition struct {
+	value   *Expression
+	equals  string
+	pattern *regexp.Regexp
+}
+
+// Compile parses every expression and pattern of the mapping.
+func Compile(m config.Mapping) (*Mapping, error) {
+	compiled := &Mapping{}
+
+	for _, field := range []struct {
+		name string
+		raw  string
+		dest **Expression
+	}{
+		{"ref", m.Ref, &compiled.ref},
+		{"url", m.URL, &compiled.url},
+		{"org", m.Org, &compiled.org},
+	} {
+		e, err := ParseExpression(field.raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q: %w", field.name, field.raw, err)
+		}
+		*field.dest = e
+	}
+
+	if m.RefName != "" {
+		e, err := ParseExpression(m.RefName)
+		if err != nil {
+			return nil, fmt.Errorf("ref_name %q: %w", m.RefName, err)
+		}
+		compiled.refName = e
+	}
+
+	for _, match := range m.Match {
+		value, err := ParseExpression(match.Value)
+		if err != nil {
+			return nil, fmt.Errorf("match %q: %w", match.Value, err)
+		}
+
+		c := condition{value: value, equals: match.Equals}
+		if match.Pattern != "" {
+			if c.pattern, err = regexp.Compile(match.Pattern); err != nil {
+				return nil, fmt.Errorf("match %q: %w", match.Value, err)
+			}
+		}
+		compiled.match = append(compiled.match, c)
+	}
+
+	return compiled, nil
+}
+
+// Apply builds a workflow from the document. It returns nil without an
+// error when a match condition does not hold, and an error naming the
+// failing expression when a field cannot be evaluated.
+func (m *Mapping) Apply(doc *models.WebhookDoc) (*models.Workflow, error) {
+	for _, c := range m.match {
+		if !c.holds(doc) {
+			return nil, nil
+		}
+	}
+
+	ref, err := eval("ref", m.ref, doc)
+	if err != nil {
+		return nil, err
+	}
+	url, err := eval("url", m.url, doc)
+	if err != nil {
+		return nil, err
+	}
+	org, err := eval("org", m.org, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	refName := ""
+	if m.refName != nil {
+		if refName, err = eval("ref_name", m.refName, doc); err != nil {
+			return nil, err
+		}
+	}
+
+	return models.NewWorkflow(doc, ref, refName, url, org), nil
+}
+
+func eval(field string, e *Expression, doc *models.WebhookDoc) (string, error) {
+	value, err := e.Eval(doc)
+	if err == nil && value == "" {
+		err = errors.New("empty value")
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s %q: %w", field, e, err)
+	}
+	return value, nil
+}
+
+// holds evaluates the condition. A field that cannot be evaluated does
+// not hold, rather than being an error, so conditions can test presence.
+func (c condition) holds(doc *models.WebhookDoc) bool {
+	value, err := c.value.Eval(doc)
+	if err != nil {
+		return false
+	}
+
+	if c.equals != "" && value != c.equals {
+		return false
+	}
+	if c.pattern != nil && !c.pattern.MatchString(value) {
+		return false
+	}
+	return value != ""
+}
@@ -0,0 +1,123 @@
+package mapping
+
+import (
+	"strings"
+	"testing"
+
+	"tsuribari/internal/config"
+)
+
+func TestMapping_Apply(t *testing.T) {
+	m, err := Compile(config.Mapping{
+		Ref:     "$.build.commit",
+		RefName: "refs/heads/{{ $.build.branch }}",
+		URL:     "git@git.example:{{ $.build.repo }}.git",
+		Org:     "tools",
+		Match: []config.Match{
+			{Value: "$header.X-Tool-Event", Equals: "build"},
+			{Value: "$.build.repo", Pattern: "^tools/"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Expected mapping to compile, got %v", err)
+	}
+
+	workflow, err := m.Apply(testDoc())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if workflow == nil {
+		t.Fatal("Expected workflow to be created, got nil")
+	}
+	if workflow.Ref != "abc123def456789" {
+		t.Errorf("Expected Ref 'abc123def456789', got '%s'", workflow.Ref)
+	}
+	if workflow.RefName != "refs/heads/main" {
+		t.Errorf("Expected RefName 'refs/heads/main', got '%s'", workflow.RefName)
+	}
+	if workflow.URL != "git@git.example:tools/widget.git" {
+		t.Errorf("Expected URL 'git@git.example:tools/widget.git', got '%s'", workflow.URL)
+	}
+	if workflow.Org != "tools" {
+		t.Errorf("Expected Org 'tools', got '%s'", workflow.Org)
+	}
+}
+
+func TestMapping_ApplyNoMatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		match config.Match
+	}{
+		{"Not equal", config.Match{Value: "$header.X-Tool-Event", Equals: "deploy"}},
+		{"Pattern", config.Match{Value: "$.build.repo", Pattern: "^infra/"}},
+		{"Missing", config.Match{Value: "$.build.tag"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Compile(config.Mapping{
+				Ref:   "$.build.commit",
+				URL:   "$.build.repo",
+				Org:   "tools",
+				Match: []config.Match{tt.match},
+			})
+			if err != nil {
+				t.Fatalf("Expected mapping to compile, got %v", err)
+			}
+
+			workflow, err := m.Apply(testDoc())
+			if err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if workflow != nil {
+				t.Errorf("Expected nil workflow, got %+v", workflow)
+			}
+		})
+	}
+}
+
+func TestMapping_ApplyErrors(t *testing.T) {
+	m, err := Compile(config.Mapping{
+		Ref: "$.build.commit",
+		URL: "git@git.example:{{ $.build.repository }}.git",
+		Org: "tools",
+	})
+	if err != nil {
+		t.Fatalf("Expected mapping to compile, got %v", err)
+	}
+
+	_, err = m.Apply(testDoc())
+	if err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+
+	// The failing expression is named, so it can be found in the config
+	expected := `url "git@git.example:{{ $.build.repository }}.git": $.build.repository not found`
+	if err.Error() != expected {
+		t.Errorf("Expected error '%s', got '%s'", expected, err)
+	}
+}
+
+func TestCompile_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping config.Mapping
+		field   string
+	}{
+		{"Bad ref", config.Mapping{Ref: "$.a..b", URL: "$.url", Org: "tools"}, "ref"},
+		{"Bad match value", config.Mapping{Ref: "$.sha", URL: "$.url", Org: "tools", Match: []config.Match{{Value: "{{ x }}"}}}, "match"},
+		{"Bad pattern", config.Mapping{Ref: "$.sha", URL: "$.url", Org: "tools", Match: []config.Match{{Value: "$.ref", Pattern: "("}}}, "match"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile(tt.mapping)
+			if err == nil {
+				t.Fatal("Expected error, got nil")
+			}
+			if !strings.HasPrefix(err.Error(), tt.field) {
+				t.Errorf("Expected error about %s, got %v", tt.field, err)
+			}
+		})
+	}
+}
@@ -1,22 +1,42 @@
 package middleware
 
 import (
-	"crypto/hmac"
-	"crypto/sha1"
-	"crypto/subtle"
-	"encoding/hex"
 	"io"
 	"net/http"
-	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+
+	"tsuribari/internal/config"
+	"tsuribari/internal/providers"
 )
 
-func HMACValidator(secrets map[string]string) gin.HandlerFunc {
+// HMACValidator checks the request signature against the secrets of
+// the addressed organisation or pipeline, using the provider the
+// registry resolves for it.
+func HMACValidator(orgs map[string]config.Organisation, registry *providers.Registry) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		org := c.Param("organisation")
-		secret, exists := secrets[org]
-		if !exists {
+		pipeline := c.Param("pipeline")
+
+		orgConfig, exists := orgs[org]
+		if exists && !orgConfig.HasPipeline(pipeline) {
+			c.Header("X-Capnhook", "unknown pipeline")
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			c.Abort()
+			return
+		}
+
+		provider, accepted := registry.Resolve(c.Request.Header, orgConfig.ProvidersFor(pipeline))
+		if !accepted {
+			c.Header("X-Capnhook", "provider not accepted")
+			c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			c.Abort()
+			return
+		}
+
+		secrets := orgConfig.SecretsFor(pipeline, time.Now())
+		if len(secrets) == 0 {
 			c.Header("X-Capnhook", "no secret found")
 			c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
 			c.Abort()
@@ -34,37 +54,38 @@ func HMACValidator(secrets map[string]string) gin.HandlerFunc {
 		// Store body for later use
 		c.Set("raw_body", body)
 
-		// Validate HMAC
-		signature := c.GetHeader("X-Hub-Signature")
-		if signature == "" {
-			signature = c.GetHeader("X-Koan-Signature")
+		// Validate HMAC against every secret currently in rotation
+		signature, found := provider.Signature(c.Request)
+		secretID := ""
+		if found {
+			for _, secret := range secrets {
+				if providers.Verify(signature, secret.Secret, body) {
+					secretID = secret.ID
+					break
+				}
+			}
 		}
-
-		if !validateHMAC(signature, secret, body) {
+		if secretID == "" {
 			c.Header("X-Capnhook", "invalid hmac")
 			c.JSON(http.StatusForbidden, gin.H{"error": "invalid hmac"})
 			c.Abort()
 			return
 		}
 
+		if min, err := providers.ParseAlgorithm(orgConfig.MinAlgorithm); err == nil && signature.Algorithm < min {
+			c.Header("X-Capnhook", "hmac algorithm too weak")
+			c.JSON(http.StatusForbidden, gin.H{"error": "invalid hmac"})
+			c.Abort()
+			return
+		}
+
 		c.Set("hmac_valid", true)
+		c.Set("hmac_algorithm", signature.Algorithm.String())
+		c.Set("secret_id", secretID)
+		c.Set("provider", provider.Name())
+		if !signature.Timestamp.IsZero() {
+			c.Set("signed_at", signature.Timestamp)
+		}
 		c.Next()
 	}
 }
-
-func validateHMAC(signature, secret string, body []byte) bool {
-	if signature == "" {
-		return false
-	}
-
-	parts := strings.SplitN(signature, "=", 2)
-	if len(parts) != 2 || parts[0] != "sha1" {
-		return false
-	}
-
-	expectedMAC := hmac.New(sha1.New, []byte(secret))
-	expectedMAC.Write(body)
-	expectedSignature := hex.EncodeToString(expectedMAC.Sum(nil))
-
-	return subtle.ConstantTimeCompare([]byte(parts[1]), []byte(expectedSignature)) == 1
-}
@@ -4,12 +4,20 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
+	"hash"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+
+	"tsuribari/internal/config"
+	"tsuribari/internal/providers"
 )
 
 func TestHMACValidator_ValidSignature(t *testing.T) {
@@ -82,7 +90,7 @@ func TestHMACValidator_ValidSignature(t *testing.T) {
 			c.Params = gin.Params{{Key: "organisation", Value: tt.org}}
 
 			// Run middleware
-			handler := HMACValidator(secrets)
+			handler := HMACValidator(orgsFromSecrets(secrets), providers.Default())
 			handler(c)
 
 			if !c.IsAborted() {
@@ -126,78 +134,613 @@ func TestHMACValidator_ValidSignature(t *testing.T) {
 	}
 }
 
-func TestValidateHMAC(t *testing.T) {
-	secret := "testsecret123"
-	body := []byte(`{"test": "data"}`)
+func orgsFromSecrets(secrets map[string]string) map[string]config.Organisation {
+	orgs := make(map[string]config.Organisation)
+	for name, secret := range secrets {
+		orgs[name] = config.Organisation{
+			Secrets: []config.Secret{{ID: "default", Secret: secret}},
+		}
+	}
+	return orgs
+}
+
+func sign(newHash func() hash.Hash, secret, body string) string {
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHMACValidator_Algorithms(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	orgs := orgsFromSecrets(map[string]string{
+		"legacy":   "legacysecret",
+		"migrated": "migratedsecret",
+	})
+	migrated := orgs["migrated"]
+	migrated.MinAlgorithm = "sha256"
+	orgs["migrated"] = migrated
+	body := `{"test": "data"}`
+
+	tests := []struct {
+		name           string
+		org            string
+		headers        map[string]string
+		expectedStatus int
+		expectedAlgo   string
+		expectedHeader string
+	}{
+		{
+			name:           "X-Koan-Signature sha256",
+			org:            "legacy",
+			headers:        map[string]string{"X-Koan-Signature": "sha256=" + sign(sha256.New, "legacysecret", body)},
+			expectedStatus: http.StatusOK,
+			expectedAlgo:   "sha256",
+		},
+		{
+			name:           "X-Koan-Signature sha512",
+			org:            "legacy",
+			headers:        map[string]string{"X-Koan-Signature": "sha512=" + sign(sha512.New, "legacysecret", body)},
+			expectedStatus: http.StatusOK,
+			expectedAlgo:   "sha512",
+		},
+		{
+			name:           "X-Hub-Signature-256",
+			org:            "migrated",
+			headers:        map[string]string{"X-Hub-Signature-256": "sha256=" + sign(sha256.New, "migratedsecret", body)},
+			expectedStatus: http.StatusOK,
+			expectedAlgo:   "sha256",
+		},
+		{
+			name: "Strongest header preferred",
+			org:  "legacy",
+			headers: map[string]string{
+				"X-Hub-Signature":     "sha1=" + sign(sha1.New, "legacysecret", body),
+				"X-Hub-Signature-256": "sha256=" + sign(sha256.New, "legacysecret", body),
+			},
+			expectedStatus: http.StatusOK,
+			expectedAlgo:   "sha256",
+		},
+		{
+			name: "Invalid strongest header is not downgraded",
+			org:  "legacy",
+			headers: map[string]string{
+				"X-Hub-Signature":     "sha1=" + sign(sha1.New, "legacysecret", body),
+				"X-Hub-Signature-256": "sha256=" + sign(sha256.New, "wrongsecret", body),
+			},
+			expectedStatus: http.StatusForbidden,
+			expectedHeader: "invalid hmac",
+		},
+		{
+			name:           "SHA-1 below minimum",
+			org:            "migrated",
+			headers:        map[string]string{"X-Hub-Signature": "sha1=" + sign(sha1.New, "migratedsecret", body)},
+			expectedStatus: http.StatusForbidden,
+			expectedHeader: "hmac algorithm too weak",
+		},
+		{
+			name:           "Unknown algorithm",
+			org:            "legacy",
+			headers:        map[string]string{"X-Koan-Signature": "md5=d41d8cd98f00b204e9800998ecf8427e"},
+			expectedStatus: http.StatusForbidden,
+			expectedHeader: "invalid hmac",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			req := httptest.NewRequest("POST", "/webhooks/"+tt.org, bytes.NewBufferString(body))
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+
+			c.Request = req
+			c.Params = gin.Params{{Key: "organisation", Value: tt.org}}
+
+			HMACValidator(orgs, providers.Default())(c)
+
+			if !c.IsAborted() {
+				c.Status(http.StatusOK)
+			}
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if tt.expectedAlgo != "" {
+				if algo := c.GetString("hmac_algorithm"); algo != tt.expectedAlgo {
+					t.Errorf("Expected algorithm %s, got %s", tt.expectedAlgo, algo)
+				}
+			}
+
+			if tt.expectedHeader != "" {
+				if header := w.Header().Get("X-Capnhook"); header != tt.expectedHeader {
+					t.Errorf("Expected X-Capnhook '%s', got '%s'", tt.expectedHeader, header)
+				}
+			}
+		})
+	}
+}
+
+func TestHMACValidator_SecretRotation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	now := time.Now()
+	orgs := map[string]config.Organisation{
+		"rotating": {
+			Secrets: []config.Secret{
+				{ID: "expired", Secret: "expiredsecret", NotAfter: now.Add(-time.Hour)},
+				{ID: "old", Secret: "oldsecret", NotAfter: now.Add(time.Hour)},
+				{ID: "new", Secret: "newsecret", NotBefore: now.Add(-time.Hour)},
+				{ID: "future", Secret: "futuresecret", NotBefore: now.Add(time.Hour)},
+			},
+		},
+		"retired": {
+			Secrets: []config.Secret{
+				{ID: "expired", Secret: "expiredsecret", NotAfter: now.Add(-time.Hour)},
+			},
+		},
+	}
+	body := `{"test": "data"}`
+
+	tests := []struct {
+		name           string
+		org            string
+		secret         string
+		expectedStatus int
+		expectedID     string
+		expectedHeader string
+	}{
+		{"Old secret still valid", "rotating", "oldsecret", http.StatusOK, "old", ""},
+		{"New secret valid", "rotating", "newsecret", http.StatusOK, "new", ""},
+		{"Expired secret rejected", "rotating", "expiredsecret", http.StatusForbidden, "", "invalid hmac"},
+		{"Future secret rejected", "rotating", "futuresecret", http.StatusForbidden, "", "invalid hmac"},
+		{"No active secret", "retired", "expiredsecret", http.StatusForbidden, "", "no secret found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			req := httptest.NewRequest("POST", "/webhooks/"+tt.org, bytes.NewBufferString(body))
+			req.Header.Set("X-Hub-Signature-256", "sha256="+sign(sha256.New, tt.secret, body))
+
+			c.Request = req
+			c.Params = gin.Params{{Key: "organisation", Value: tt.org}}
+
+			HMACValidator(orgs, providers.Default())(c)
+
+			if !c.IsAborted() {
+				c.Status(http.StatusOK)
+			}
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if id := c.GetString("secret_id"); id != tt.expectedID {
+				t.Errorf("Expected secret_id '%s', got '%s'", tt.expectedID, id)
+			}
+
+			if tt.expectedHeader != "" {
+				if header := w.Header().Get("X-Capnhook"); header != tt.expectedHeader {
+					t.Errorf("Expected X-Capnhook '%s', got '%s'", tt.expectedHeader, header)
+				}
+			}
+		})
+	}
+}
+
+func TestHMACValidator_Pipelines(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	orgs := map[string]config.Organisation{
+		"demo": {
+			Secrets: []config.Secret{{ID: "org", Secret: "orgsecret"}},
+			Pipelines: map[string]config.Pipeline{
+				"inherits": {},
+				"scoped": {
+					Secrets: []config.Secret{{ID: "scoped", Secret: "scopedsecret"}},
+				},
+			},
+		},
+	}
+	body := `{"test": "data"}`
+
+	tests := []struct {
+		name           string
+		pipeline       string
+		secret         string
+		expectedStatus int
+		expectedID     string
+		expectedHeader string
+	}{
+		{"Organisation route", "", "orgsecret", http.StatusOK, "org", ""},
+		{"Pipeline falls back to organisation secret", "inherits", "orgsecret", http.StatusOK, "org", ""},
+		{"Pipeline secret", "scoped", "scopedsecret", http.StatusOK, "scoped", ""},
+		{"Organisation secret rejected for scoped pipeline", "scoped", "orgsecret", http.StatusForbidden, "", "invalid hmac"},
+		{"Unknown pipeline", "unknown", "orgsecret", http.StatusNotFound, "", "unknown pipeline"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			req := httptest.NewRequest("POST", "/webhooks/demo/"+tt.pipeline, bytes.NewBufferString(body))
+			req.Header.Set("X-Hub-Signature-256", "sha256="+sign(sha256.New, tt.secret, body))
+
+			c.Request = req
+			c.Params = gin.Params{{Key: "organisation", Value: "demo"}}
+			if tt.pipeline != "" {
+				c.Params = append(c.Params, gin.Param{Key: "pipeline", Value: tt.pipeline})
+			}
+
+			HMACValidator(orgs, providers.Default())(c)
+
+			if !c.IsAborted() {
+				c.Status(http.StatusOK)
+			}
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if id := c.GetString("secret_id"); id != tt.expectedID {
+				t.Errorf("Expected secret_id '%s', got '%s'", tt.expectedID, id)
+			}
+
+			if tt.expectedHeader != "" {
+				if header := w.Header().Get("X-Capnhook"); header != tt.expectedHeader {
+					t.Errorf("Expected X-Capnhook '%s', got '%s'", tt.expectedHeader, header)
+				}
+			}
+		})
+	}
+}
+
+func TestHMACValidator_TimestampedSignature(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	orgs := orgsFromSecrets(map[string]string{"demo": "demosecret"})
+	body := `{"test": "data"}`
+	signedAt := time.Now().Unix()
+	timestamp := strconv.FormatInt(signedAt, 10)
+
+	tests := []struct {
+		name           string
+		header         string
+		expectedStatus int
+	}{
+		{
+			name:           "Valid timestamped signature",
+			header:         "t=" + timestamp + ",v1=" + sign(sha256.New, "demosecret", timestamp+"."+body),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Timestamp not covered by signature",
+			header:         "t=" + timestamp + ",v1=" + sign(sha256.New, "demosecret", body),
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Tampered timestamp",
+			header:         "t=" + strconv.FormatInt(signedAt+1, 10) + ",v1=" + sign(sha256.New, "demosecret", timestamp+"."+body),
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Missing v1",
+			header:         "t=" + timestamp,
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			req := httptest.NewRequest("POST", "/webhooks/demo", bytes.NewBufferString(body))
+			req.Header.Set("X-Koan-Signature", tt.header)
+
+			c.Request = req
+			c.Params = gin.Params{{Key: "organisation", Value: "demo"}}
+
+			HMACValidator(orgs, providers.Default())(c)
+
+			if !c.IsAborted() {
+				c.Status(http.StatusOK)
+			}
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if tt.expectedStatus == http.StatusOK {
+				signed, exists := c.Get("signed_at")
+				if !exists || signed.(time.Time).Unix() != signedAt {
+					t.Errorf("Expected signed_at %d, got %v", signedAt, signed)
+				}
+			}
+		})
+	}
+}
+
+func TestHMACValidator_GitLabToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	orgs := orgsFromSecrets(map[string]string{
+		"gitlab": "gitlabtoken",
+		"strict": "stricttoken",
+	})
+	strict := orgs["strict"]
+	strict.MinAlgorithm = "sha1"
+	orgs["strict"] = strict
+	body := `{"object_kind": "push"}`
+
+	tests := []struct {
+		name           string
+		org            string
+		headers        map[string]string
+		expectedStatus int
+		expectedAlgo   string
+		expectedHeader string
+	}{
+		{
+			name:           "Valid token",
+			org:            "gitlab",
+			headers:        map[string]string{"X-Gitlab-Token": "gitlabtoken"},
+			expectedStatus: http.StatusOK,
+			expectedAlgo:   "token",
+		},
+		{
+			name:           "Wrong token",
+			org:            "gitlab",
+			headers:        map[string]string{"X-Gitlab-Token": "gitlabtoke"},
+			expectedStatus: http.StatusForbidden,
+			expectedHeader: "invalid hmac",
+		},
+		{
+			name: "HMAC preferred over token",
+			org:  "gitlab",
+			headers: map[string]string{
+				"X-Gitlab-Token":      "wrongtoken",
+				"X-Hub-Signature-256": "sha256=" + sign(sha256.New, "gitlabtoken", body),
+			},
+			expectedStatus: http.StatusOK,
+			expectedAlgo:   "sha256",
+		},
+		{
+			name:           "Token below minimum",
+			org:            "strict",
+			headers:        map[string]string{"X-Gitlab-Token": "stricttoken"},
+			expectedStatus: http.StatusForbidden,
+			expectedHeader: "hmac algorithm too weak",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			req := httptest.NewRequest("POST", "/webhooks/"+tt.org, bytes.NewBufferString(body))
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+
+			c.Request = req
+			c.Params = gin.Params{{Key: "organisation", Value: tt.org}}
+
+			HMACValidator(orgs, providers.Default())(c)
+
+			if !c.IsAborted() {
+				c.Status(http.StatusOK)
+			}
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if tt.expectedAlgo != "" {
+				if algo := c.GetString("hmac_algorithm"); algo != tt.expectedAlgo {
+					t.Errorf("Expected algorithm %s, got %s", tt.expectedAlgo, algo)
+				}
+			}
+
+			if tt.expectedHeader != "" {
+				if header := w.Header().Get("X-Capnhook"); header != tt.expectedHeader {
+					t.Errorf("Expected X-Capnhook '%s', got '%s'", tt.expectedHeader, header)
+				}
+			}
+		})
+	}
+}
+
+func TestHMACValidator_ForgejoSignature(t *testing.T) {
+	gin.SetMode(gin.TestMode)
 
-	// Generate valid signature
-	mac := hmac.New(sha1.New, []byte(secret))
-	mac.Write(body)
-	validSignature := "sha1=" + hex.EncodeToString(mac.Sum(nil))
+	orgs := orgsFromSecrets(map[string]string{"forgejo": "forgejosecret"})
+	body := `{"ref": "refs/heads/main"}`
+	digest := sign(sha256.New, "forgejosecret", body)
 
 	tests := []struct {
-		name      string
-		signature string
-		secret    string
-		body      []byte
-		expected  bool
+		name           string
+		headers        map[string]string
+		expectedStatus int
 	}{
 		{
-			name:      "Valid signature",
-			signature: validSignature,
-			secret:    secret,
-			body:      body,
-			expected:  true,
+			name:           "Forgejo signature",
+			headers:        map[string]string{"X-Forgejo-Signature": digest},
+			expectedStatus: http.StatusOK,
 		},
 		{
-			name:      "Invalid signature",
-			signature: "sha1=invalidsignature",
-			secret:    secret,
-			body:      body,
-			expected:  false,
+			name:           "Gitea signature",
+			headers:        map[string]string{"X-Gitea-Signature": digest},
+			expectedStatus: http.StatusOK,
 		},
 		{
-			name:      "Wrong secret",
-			signature: validSignature,
-			secret:    "wrongsecret",
-			body:      body,
-			expected:  false,
+			name:           "Prefixed digest",
+			headers:        map[string]string{"X-Forgejo-Signature": "sha256=" + digest},
+			expectedStatus: http.StatusForbidden,
 		},
 		{
-			name:      "Empty signature",
-			signature: "",
-			secret:    secret,
-			body:      body,
-			expected:  false,
+			name:           "Wrong secret",
+			headers:        map[string]string{"X-Gitea-Signature": sign(sha256.New, "wrongsecret", body)},
+			expectedStatus: http.StatusForbidden,
 		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			req := httptest.NewRequest("POST", "/webhooks/forgejo", bytes.NewBufferString(body))
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+
+			c.Request = req
+			c.Params = gin.Params{{Key: "organisation", Value: "forgejo"}}
+
+			HMACValidator(orgs, providers.Default())(c)
+
+			if !c.IsAborted() {
+				c.Status(http.StatusOK)
+			}
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if tt.expectedStatus == http.StatusOK {
+				if algo := c.GetString("hmac_algorithm"); algo != "sha256" {
+					t.Errorf("Expected algorithm sha256, got %s", algo)
+				}
+			}
+		})
+	}
+}
+
+func TestHMACValidator_Providers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	orgs := orgsFromSecrets(map[string]string{
+		"any":       "anysecret",
+		"bitbucket": "bitbuckettoken",
+	})
+	bitbucket := orgs["bitbucket"]
+	bitbucket.Providers = []string{"bitbucket-cloud", "bitbucket-datacenter"}
+	orgs["bitbucket"] = bitbucket
+	body := `{"push": {"changes": []}}`
+
+	cloud := map[string]string{
+		"X-Event-Key": "repo:push",
+		"X-Hook-UUID": "b4a6c1d2-3e4f-4a5b-8c6d-7e8f9a0b1c2d",
+	}
+
+	tests := []struct {
+		name             string
+		org              string
+		query            string
+		headers          map[string]string
+		expectedStatus   int
+		expectedProvider string
+		expectedHeader   string
+	}{
 		{
-			name:      "Wrong algorithm",
-			signature: "sha256=somehash",
-			secret:    secret,
-			body:      body,
-			expected:  false,
+			name:             "Cloud token in query",
+			org:              "bitbucket",
+			query:            "?token=bitbuckettoken",
+			headers:          cloud,
+			expectedStatus:   http.StatusOK,
+			expectedProvider: "bitbucket-cloud",
 		},
 		{
-			name:      "Malformed signature",
-			signature: "invalidsignature",
-			secret:    secret,
-			body:      body,
-			expected:  false,
+			name:           "Cloud wrong token",
+			org:            "bitbucket",
+			query:          "?token=wrongtoken",
+			headers:        cloud,
+			expectedStatus: http.StatusForbidden,
+			expectedHeader: "invalid hmac",
 		},
 		{
-			name:      "Different body",
-			signature: validSignature,
-			secret:    secret,
-			body:      []byte(`{"different": "data"}`),
-			expected:  false,
+			name: "Data Center signature",
+			org:  "bitbucket",
+			headers: map[string]string{
+				"X-Event-Key":     "repo:refs_changed",
+				"X-Hub-Signature": "sha256=" + sign(sha256.New, "bitbuckettoken", body),
+			},
+			expectedStatus:   http.StatusOK,
+			expectedProvider: "bitbucket-datacenter",
+		},
+		{
+			name:  "Data Center token in query",
+			org:   "bitbucket",
+			query: "?token=bitbuckettoken",
+			headers: map[string]string{
+				"X-Event-Key": "repo:refs_changed",
+			},
+			expectedStatus: http.StatusForbidden,
+			expectedHeader: "invalid hmac",
+		},
+		{
+			name:  "Provider not accepted",
+			org:   "bitbucket",
+			query: "?token=bitbuckettoken",
+			headers: map[string]string{
+				"X-Hub-Signature-256": "sha256=" + sign(sha256.New, "bitbuckettoken", body),
+			},
+			expectedStatus: http.StatusForbidden,
+			expectedHeader: "provider not accepted",
+		},
+		{
+			name:             "All providers accepted",
+			org:              "any",
+			query:            "?token=anysecret",
+			headers:          cloud,
+			expectedStatus:   http.StatusOK,
+			expectedProvider: "bitbucket-cloud",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := validateHMAC(tt.signature, tt.secret, tt.body)
-			if result != tt.expected {
-				t.Errorf("Expected %v, got %v", tt.expected, result)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			req := httptest.NewRequest("POST", "/webhooks/"+tt.org+tt.query, bytes.NewBufferString(body))
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+
+			c.Request = req
+			c.Params = gin.Params{{Key: "organisation", Value: tt.org}}
+
+			HMACValidator(orgs, providers.Default())(c)
+
+			if !c.IsAborted() {
+				c.Status(http.StatusOK)
+			}
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if tt.expectedProvider != "" {
+				if provider := c.GetString("provider"); provider != tt.expectedProvider {
+					t.Errorf("Expected provider %s, got %s", tt.expectedProvider, provider)
+				}
+			}
+
+			if tt.expectedHeader != "" {
+				if header := w.Header().Get("X-Capnhook"); header != tt.expectedHeader {
+					t.Errorf("Expected X-Capnhook '%s', got '%s'", tt.expectedHeader, header)
+				}
 			}
 		})
 	}
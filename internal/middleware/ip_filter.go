@@ -1,17 +1,34 @@
 package middleware
 
 import (
+	"log"
 	"net"
 	"net/http"
+	"net/netip"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+
+	"tsuribari/internal/config"
+	"tsuribari/internal/ipset"
 )
 
-func IPFilter(trustedIPs []string) gin.HandlerFunc {
+// IPSource supplies trusted CIDRs that may change at runtime.
+type IPSource interface {
+	Set() *ipset.Set
+}
+
+// IPFilter admits requests whose client IP is in trustedIPs or in any of
+// the sources. Forwarding headers are only believed when the socket peer
+// is in trustedProxies. Both lists must have passed config validation.
+func IPFilter(trustedIPs, trustedProxies []string, sources ...IPSource) gin.HandlerFunc {
+	trusted := ipset.MustParse(trustedIPs)
+	proxies := ipset.MustParse(trustedProxies)
+
 	return func(c *gin.Context) {
-		clientIP := getClientIP(c)
+		clientIP := getClientIP(c, proxies)
 
-		if !isTrustedIP(clientIP, trustedIPs) {
+		if !trusted.Contains(clientIP) && !inSources(clientIP, sources) {
 			c.Header("X-Capnhook", "invalid source ip")
 			c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
 			c.Abort()
@@ -19,38 +36,178 @@ func IPFilter(trustedIPs []string) gin.HandlerFunc {
 		}
 
 		c.Set("trusted_ip", true)
+		c.Set("client_ip", clientIP)
 		c.Next()
 	}
 }
 
-func getClientIP(c *gin.Context) string {
-	// Check X-Real-IP header first (from proxy)
-	if realIP := c.GetHeader("X-Real-IP"); realIP != "" {
-		return realIP
+// OrgIPFilter applies the allow and deny lists of the addressed
+// organisation and pipeline. It must run after IPFilter. Deny rules take
+// precedence, and every level with an allow list must be satisfied.
+func OrgIPFilter(orgs map[string]config.Organisation) gin.HandlerFunc {
+	type scope struct {
+		name    string
+		allowed *ipset.Set
+		denied  *ipset.Set
+	}
+
+	compile := func(name string, rules config.IPRules) scope {
+		return scope{
+			name:    name,
+			allowed: ipset.MustParse(rules.AllowedIPs),
+			denied:  ipset.MustParse(rules.DeniedIPs),
+		}
 	}
 
-	// Check X-Forwarded-For header
-	if forwardedFor := c.GetHeader("X-Forwarded-For"); forwardedFor != "" {
-		return forwardedFor
+	orgScopes := make(map[string]scope)
+	pipelineScopes := make(map[string]scope)
+	for org, orgConfig := range orgs {
+		orgScopes[org] = compile(org, orgConfig.IPRules)
+		for pipeline, p := range orgConfig.Pipelines {
+			pipelineScopes[org+"/"+pipeline] = compile(org+"/"+pipeline, p.IPRules)
+		}
 	}
 
-	// Fall back to remote address
-	ip, _, _ := net.SplitHostPort(c.Request.RemoteAddr)
-	return ip
+	return func(c *gin.Context) {
+		org := c.Param("organisation")
+		pipeline := c.Param("pipeline")
+		clientIP, _ := c.Get("client_ip")
+		addr, _ := clientIP.(netip.Addr)
+
+		var scopes []scope
+		if s, ok := orgScopes[org]; ok {
+			scopes = append(scopes, s)
+		}
+		if s, ok := pipelineScopes[org+"/"+pipeline]; ok {
+			scopes = append(scopes, s)
+		}
+
+		for _, s := range scopes {
+			if entry, ok := s.denied.Lookup(addr); ok {
+				rejectByRule(c, addr, "denied by "+s.name+" deny "+entry)
+				return
+			}
+		}
+
+		for _, s := range scopes {
+			if s.allowed.Len() == 0 {
+				continue
+			}
+			entry, ok := s.allowed.Lookup(addr)
+			if !ok {
+				rejectByRule(c, addr, "not allowed by "+s.name+" allow")
+				return
+			}
+			// The pipeline's entry, checked last, is the one reported
+			reason := "allowed by " + s.name + " allow " + entry
+			log.Printf("INFO: %s %s", addr, reason)
+			c.Header("X-Capnhook", reason)
+		}
+
+		c.Next()
+	}
 }
 
-func isTrustedIP(clientIP string, trustedIPs []string) bool {
-	for _, trustedIP := range trustedIPs {
-		if clientIP == trustedIP {
-			return true
+func rejectByRule(c *gin.Context, addr netip.Addr, reason string) {
+	log.Printf("INFO: %s %s", addr, reason)
+	c.Header("X-Capnhook", reason)
+	c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+	c.Abort()
+}
+
+// getClientIP returns the client address, or the invalid zero address
+// if a header that must be believed cannot be parsed.
+func getClientIP(c *gin.Context, trustedProxies *ipset.Set) netip.Addr {
+	// The socket peer is the only address we know to be genuine
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		host = c.Request.RemoteAddr
+	}
+	peer, _ := ipset.ParseAddr(host)
+
+	// Anyone can set forwarding headers, so only trust them from proxies
+	if !trustedProxies.Contains(peer) {
+		return peer
+	}
+
+	// Prefer RFC 7239 Forwarded, then X-Forwarded-For
+	hops := forwardedHops(c.Request.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		hops = forwardedForHops(c.Request.Header.Values("X-Forwarded-For"))
+	}
+	if len(hops) > 0 {
+		return walkHops(hops, trustedProxies)
+	}
+
+	// Check X-Real-IP header (from proxy)
+	if realIP := c.GetHeader("X-Real-IP"); realIP != "" {
+		addr, _ := ipset.ParseAddr(realIP)
+		return addr
+	}
+
+	return peer
+}
+
+// walkHops returns the rightmost hop that is not a trusted proxy, since
+// everything left of it may have been supplied by the client.
+func walkHops(hops []string, trustedProxies *ipset.Set) netip.Addr {
+	var addr netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		var err error
+		addr, err = ipset.ParseAddr(hops[i])
+		if err != nil {
+			return netip.Addr{}
 		}
+		if !trustedProxies.Contains(addr) {
+			return addr
+		}
+	}
+	return addr
+}
 
-		// Check if it's a CIDR range
-		if _, cidr, err := net.ParseCIDR(trustedIP); err == nil {
-			if ip := net.ParseIP(clientIP); ip != nil && cidr.Contains(ip) {
-				return true
+func forwardedForHops(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, stripPort(hop))
 			}
 		}
 	}
+	return hops
+}
+
+// forwardedHops extracts the for= parameters of an RFC 7239 header, e.g.
+// `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`.
+func forwardedHops(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				hops = append(hops, stripPort(strings.Trim(val, `"`)))
+			}
+		}
+	}
+	return hops
+}
+
+// stripPort removes an optional port and IPv6 brackets from a hop.
+func stripPort(hop string) string {
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+}
+
+func inSources(clientIP netip.Addr, sources []IPSource) bool {
+	for _, source := range sources {
+		if source.Set().Contains(clientIP) {
+			return true
+		}
+	}
 	return false
 }
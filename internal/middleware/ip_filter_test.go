@@ -3,15 +3,20 @@ package middleware
 import (
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"testing"
 
 	"github.com/gin-gonic/gin"
+
+	"tsuribari/internal/config"
+	"tsuribari/internal/ipset"
 )
 
 func TestIPFilter_TrustedIP(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	trustedIPs := []string{"192.168.1.100", "10.0.0.0/8"}
+	trustedProxies := []string{"172.16.0.1"}
 
 	tests := []struct {
 		name           string
@@ -27,30 +32,47 @@ func TestIPFilter_TrustedIP(t *testing.T) {
 			expectedStatus: http.StatusOK,
 		},
 		{
-			name:           "X-Real-IP trusted",
-			remoteAddr:     "1.2.3.4:12345",
+			name:           "X-Real-IP trusted via proxy",
+			remoteAddr:     "172.16.0.1:12345",
 			xRealIP:        "192.168.1.100",
 			expectedStatus: http.StatusOK,
 		},
 		{
-			name:           "X-Forwarded-For trusted",
-			remoteAddr:     "1.2.3.4:12345",
+			name:           "X-Forwarded-For trusted via proxy",
+			remoteAddr:     "172.16.0.1:12345",
 			xForwardedFor:  "192.168.1.100",
 			expectedStatus: http.StatusOK,
 		},
+		{
+			name:           "X-Real-IP spoofed by untrusted peer",
+			remoteAddr:     "1.2.3.4:12345",
+			xRealIP:        "192.168.1.100",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "X-Forwarded-For spoofed by untrusted peer",
+			remoteAddr:     "1.2.3.4:12345",
+			xForwardedFor:  "192.168.1.100",
+			expectedStatus: http.StatusForbidden,
+		},
 		{
 			name:           "CIDR range match",
 			remoteAddr:     "10.1.2.3:12345",
 			expectedStatus: http.StatusOK,
 		},
+		{
+			name:           "IPv4-mapped IPv6 peer",
+			remoteAddr:     "[::ffff:192.168.1.100]:12345",
+			expectedStatus: http.StatusOK,
+		},
 		{
 			name:           "Untrusted IP",
 			remoteAddr:     "1.2.3.4:12345",
 			expectedStatus: http.StatusForbidden,
 		},
 		{
-			name:           "X-Real-IP untrusted",
-			remoteAddr:     "192.168.1.100:12345",
+			name:           "X-Real-IP untrusted via proxy",
+			remoteAddr:     "172.16.0.1:12345",
 			xRealIP:        "1.2.3.4",
 			expectedStatus: http.StatusForbidden,
 		},
@@ -75,7 +97,7 @@ func TestIPFilter_TrustedIP(t *testing.T) {
 			c.Request = req
 
 			// Add a handler that sets status OK if middleware passes
-			handler := IPFilter(trustedIPs)
+			handler := IPFilter(trustedIPs, trustedProxies)
 			handler(c)
 
 			if !c.IsAborted() {
@@ -105,24 +127,33 @@ func TestIPFilter_TrustedIP(t *testing.T) {
 func TestGetClientIP(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
+	trustedProxies := ipset.MustParse([]string{"1.2.3.4", "10.10.0.0/16", "2001:db8::1"})
+
 	tests := []struct {
 		name          string
 		remoteAddr    string
 		xRealIP       string
-		xForwardedFor string
+		xForwardedFor []string
+		forwarded     string
 		expectedIP    string
 	}{
 		{
-			name:          "X-Real-IP priority",
+			name:          "X-Forwarded-For before X-Real-IP",
 			remoteAddr:    "1.2.3.4:12345",
 			xRealIP:       "192.168.1.100",
-			xForwardedFor: "10.0.0.1",
-			expectedIP:    "192.168.1.100",
+			xForwardedFor: []string{"10.0.0.1"},
+			expectedIP:    "10.0.0.1",
+		},
+		{
+			name:       "X-Real-IP from trusted proxy",
+			remoteAddr: "1.2.3.4:12345",
+			xRealIP:    "192.168.1.100",
+			expectedIP: "192.168.1.100",
 		},
 		{
 			name:          "X-Forwarded-For fallback",
 			remoteAddr:    "1.2.3.4:12345",
-			xForwardedFor: "10.0.0.1",
+			xForwardedFor: []string{"10.0.0.1"},
 			expectedIP:    "10.0.0.1",
 		},
 		{
@@ -135,6 +166,45 @@ func TestGetClientIP(t *testing.T) {
 			remoteAddr: "[::1]:12345",
 			expectedIP: "::1",
 		},
+		{
+			name:          "Headers ignored from untrusted peer",
+			remoteAddr:    "5.6.7.8:12345",
+			xRealIP:       "192.168.1.100",
+			xForwardedFor: []string{"10.0.0.1"},
+			forwarded:     "for=10.0.0.2",
+			expectedIP:    "5.6.7.8",
+		},
+		{
+			name:          "Multi-hop X-Forwarded-For skips trusted hops",
+			remoteAddr:    "1.2.3.4:12345",
+			xForwardedFor: []string{"6.6.6.6, 192.168.1.100, 10.10.3.4"},
+			expectedIP:    "192.168.1.100",
+		},
+		{
+			name:          "Multiple X-Forwarded-For headers",
+			remoteAddr:    "1.2.3.4:12345",
+			xForwardedFor: []string{"6.6.6.6", "192.168.1.100:4711, 10.10.3.4"},
+			expectedIP:    "192.168.1.100",
+		},
+		{
+			name:          "All hops trusted",
+			remoteAddr:    "1.2.3.4:12345",
+			xForwardedFor: []string{"10.10.1.1, 10.10.2.2"},
+			expectedIP:    "10.10.1.1",
+		},
+		{
+			name:          "Forwarded preferred over X-Forwarded-For",
+			remoteAddr:    "1.2.3.4:12345",
+			xForwardedFor: []string{"10.0.0.1"},
+			forwarded:     "for=192.0.2.60;proto=https;by=1.2.3.4",
+			expectedIP:    "192.0.2.60",
+		},
+		{
+			name:       "Forwarded with IPv6 and port",
+			remoteAddr: "[2001:db8::1]:443",
+			forwarded:  `for=192.0.2.43, for="[2001:db8:cafe::17]:4711"`,
+			expectedIP: "2001:db8:cafe::17",
+		},
 	}
 
 	for _, tt := range tests {
@@ -148,50 +218,131 @@ func TestGetClientIP(t *testing.T) {
 			if tt.xRealIP != "" {
 				req.Header.Set("X-Real-IP", tt.xRealIP)
 			}
-			if tt.xForwardedFor != "" {
-				req.Header.Set("X-Forwarded-For", tt.xForwardedFor)
+			for _, value := range tt.xForwardedFor {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.forwarded != "" {
+				req.Header.Set("Forwarded", tt.forwarded)
 			}
 
 			c.Request = req
 
-			ip := getClientIP(c)
-			if ip != tt.expectedIP {
+			ip := getClientIP(c, trustedProxies)
+			if ip.String() != tt.expectedIP {
 				t.Errorf("Expected IP %s, got %s", tt.expectedIP, ip)
 			}
 		})
 	}
 }
 
-func TestIsTrustedIP(t *testing.T) {
-	trustedIPs := []string{
-		"192.168.1.100",
-		"10.0.0.0/8",
-		"172.16.0.0/12",
-		"::1",
-		"2001:db8::/32",
+type staticSource []string
+
+func (s staticSource) Set() *ipset.Set {
+	return ipset.MustParse(s)
+}
+
+func TestIPFilter_Sources(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	handler := IPFilter([]string{"192.168.1.100"}, nil, staticSource{"192.30.252.0/22"}, staticSource{})
+
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		expectedStatus int
+	}{
+		{"Static list", "192.168.1.100:12345", http.StatusOK},
+		{"Dynamic source", "192.30.253.1:12345", http.StatusOK},
+		{"Neither", "1.2.3.4:12345", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			req := httptest.NewRequest("GET", "/test", nil)
+			req.RemoteAddr = tt.remoteAddr
+			c.Request = req
+
+			handler(c)
+
+			if !c.IsAborted() {
+				c.Status(http.StatusOK)
+			}
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestOrgIPFilter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	orgs := map[string]config.Organisation{
+		"demo": {
+			IPRules: config.IPRules{
+				AllowedIPs: []string{"10.0.0.0/8"},
+				DeniedIPs:  []string{"10.66.0.0/16"},
+			},
+			Pipelines: map[string]config.Pipeline{
+				"release": {
+					IPRules: config.IPRules{
+						AllowedIPs: []string{"10.1.0.0/16"},
+					},
+				},
+				"docs": {
+					IPRules: config.IPRules{
+						AllowedIPs: []string{"10.66.1.1"},
+					},
+				},
+			},
+		},
 	}
 
 	tests := []struct {
-		name     string
-		clientIP string
-		expected bool
+		name           string
+		org            string
+		pipeline       string
+		clientIP       string
+		expectedStatus int
+		expectedHeader string
 	}{
-		{"Exact match IPv4", "192.168.1.100", true},
-		{"CIDR match 10.x", "10.1.2.3", true},
-		{"CIDR match 172.16.x", "172.16.1.1", true},
-		{"CIDR no match", "172.15.1.1", false},
-		{"No match", "1.2.3.4", false},
-		{"IPv6 exact", "::1", true},
-		{"IPv6 CIDR match", "2001:db8::1", true},
-		{"IPv6 no match", "2001:db9::1", false},
-		{"Invalid IP", "invalid", false},
+		{"Organisation allow", "demo", "", "10.2.3.4", http.StatusOK, "allowed by demo allow 10.0.0.0/8"},
+		{"Organisation allow missed", "demo", "", "192.168.1.1", http.StatusForbidden, "not allowed by demo allow"},
+		{"Organisation deny", "demo", "", "10.66.1.1", http.StatusForbidden, "denied by demo deny 10.66.0.0/16"},
+		{"Pipeline narrows organisation", "demo", "release", "10.1.2.3", http.StatusOK, "allowed by demo/release allow 10.1.0.0/16"},
+		{"Pipeline allow missed", "demo", "release", "10.2.3.4", http.StatusForbidden, "not allowed by demo/release allow"},
+		{"Deny beats pipeline allow", "demo", "docs", "10.66.1.1", http.StatusForbidden, "denied by demo deny 10.66.0.0/16"},
+		{"Organisation without rules", "other", "", "192.168.1.1", http.StatusOK, ""},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := isTrustedIP(tt.clientIP, trustedIPs)
-			if result != tt.expected {
-				t.Errorf("Expected %v for IP %s, got %v", tt.expected, tt.clientIP, result)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			c.Request = httptest.NewRequest("POST", "/webhooks/"+tt.org, nil)
+			c.Params = gin.Params{{Key: "organisation", Value: tt.org}}
+			if tt.pipeline != "" {
+				c.Params = append(c.Params, gin.Param{Key: "pipeline", Value: tt.pipeline})
+			}
+			c.Set("client_ip", netip.MustParseAddr(tt.clientIP))
+
+			OrgIPFilter(orgs)(c)
+
+			if !c.IsAborted() {
+				c.Status(http.StatusOK)
+			}
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if header := w.Header().Get("X-Capnhook"); header != tt.expectedHeader {
+				t.Errorf("Expected X-Capnhook '%s', got '%s'", tt.expectedHeader, header)
 			}
 		})
 	}
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRedactQuery(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/webhooks/acme":                      "/webhooks/acme",
+		"/webhooks/acme?token=s3cr3t":         "/webhooks/acme?token=[redacted]",
+		"/webhooks/acme?a=1&token=s3cr3t&b=2": "/webhooks/acme?a=1&token=[redacted]&b=2",
+		"/webhooks/acme?to%6Ben=s3cr3t":       "/webhooks/acme?to%6Ben=[redacted]",
+		"/webhooks/acme?tokens=kept":          "/webhooks/acme?tokens=kept",
+	} {
+		if got := RedactQuery(path); got != expected {
+			t.Errorf("Expected %s to give %s, got %s", path, expected, got)
+		}
+	}
+}
+
+func TestLogger_RedactsToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var logged bytes.Buffer
+	previous := gin.DefaultWriter
+	gin.DefaultWriter = &logged
+	defer func() { gin.DefaultWriter = previous }()
+
+	router := gin.New()
+	router.Use(Logger())
+	router.POST("/webhooks/:organisation", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/webhooks/acme?token=s3cr3t", nil))
+
+	if strings.Contains(logged.String(), "s3cr3t") {
+		t.Errorf("Expected token to be redacted, got %s", logged.String())
+	}
+	if !strings.Contains(logged.String(), "/webhooks/acme?token=[redacted]") {
+		t.Errorf("Expected redacted path to be logged, got %s", logged.String())
+	}
+}
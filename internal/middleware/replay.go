@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"tsuribari/internal/config"
+)
+
+// DeliveryHeaders lists the headers senders use to identify a delivery.
+var DeliveryHeaders = []string{
+	"X-GitHub-Delivery",
+	"X-Gitea-Delivery",
+	"X-Forgejo-Delivery",
+	"X-Gitlab-Event-UUID",
+	"X-Koan-Delivery",
+}
+
+// ReplayGuard rejects signed timestamps outside the configured skew and
+// deliveries whose ID has already been seen. It must run after
+// HMACValidator, so that only authenticated deliveries are remembered.
+func ReplayGuard(replay config.Replay) gin.HandlerFunc {
+	seen := newDeliveryCache(replay.DeliveryTTL)
+
+	return func(c *gin.Context) {
+		if signedAt, ok := c.Get("signed_at"); ok && replay.MaxSkew > 0 {
+			skew := time.Since(signedAt.(time.Time))
+			if skew > replay.MaxSkew || skew < -replay.MaxSkew {
+				c.Header("X-Capnhook", "stale timestamp")
+				c.JSON(http.StatusForbidden, gin.H{"error": "stale timestamp"})
+				c.Abort()
+				return
+			}
+		}
+
+		deliveryID := getDeliveryID(c)
+		if deliveryID == "" {
+			c.Next()
+			return
+		}
+		c.Set("delivery_id", deliveryID)
+
+		if replay.DeliveryTTL <= 0 {
+			c.Next()
+			return
+		}
+
+		key := c.Param("organisation") + "/" + deliveryID
+		if !seen.reserve(key, time.Now()) {
+			if replay.Duplicates == "acknowledge" {
+				c.JSON(http.StatusOK, gin.H{"message": "duplicate delivery acknowledged"})
+			} else {
+				c.Header("X-Capnhook", "duplicate delivery")
+				c.JSON(http.StatusConflict, gin.H{"error": "duplicate delivery"})
+			}
+			c.Abort()
+			return
+		}
+
+		c.Next()
+
+		// Let the sender retry deliveries we failed to process
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			seen.release(key)
+		}
+	}
+}
+
+func getDeliveryID(c *gin.Context) string {
+	for _, header := range DeliveryHeaders {
+		if id := c.GetHeader(header); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// deliveryCache remembers delivery IDs until their TTL expires.
+type deliveryCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	expires   map[string]time.Time
+	lastSweep time.Time
+}
+
+func newDeliveryCache(ttl time.Duration) *deliveryCache {
+	return &deliveryCache{
+		ttl:     ttl,
+		expires: make(map[string]time.Time),
+	}
+}
+
+// reserve records the key and reports whether it was previously unseen.
+func (d *deliveryCache) reserve(key string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.lastSweep) > d.ttl {
+		for k, expiry := range d.expires {
+			if !now.Before(expiry) {
+				delete(d.expires, k)
+			}
+		}
+		d.lastSweep = now
+	}
+
+	if expiry, exists := d.expires[key]; exists && now.Before(expiry) {
+		return false
+	}
+	d.expires[key] = now.Add(d.ttl)
+	return true
+}
+
+func (d *deliveryCache) release(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.expires, key)
+}
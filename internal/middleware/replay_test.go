@@ -0,0 +1,159 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"tsuribari/internal/config"
+)
+
+func TestReplayGuard_SignedTimestamp(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	replay := config.Replay{MaxSkew: 5 * time.Minute}
+
+	tests := []struct {
+		name           string
+		signedAt       time.Time
+		expectedStatus int
+	}{
+		{"No signed timestamp", time.Time{}, http.StatusOK},
+		{"Fresh timestamp", time.Now().Add(-time.Minute), http.StatusOK},
+		{"Stale timestamp", time.Now().Add(-10 * time.Minute), http.StatusForbidden},
+		{"Future timestamp", time.Now().Add(10 * time.Minute), http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/webhooks/demo", nil)
+			if !tt.signedAt.IsZero() {
+				c.Set("signed_at", tt.signedAt)
+			}
+
+			ReplayGuard(replay)(c)
+
+			if !c.IsAborted() {
+				c.Status(http.StatusOK)
+			}
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if tt.expectedStatus == http.StatusForbidden {
+				if header := w.Header().Get("X-Capnhook"); header != "stale timestamp" {
+					t.Errorf("Expected 'stale timestamp' header, got '%s'", header)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayGuard_DeliveryIDs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name           string
+		duplicates     string
+		expectedStatus int
+	}{
+		{"Reject duplicates", "reject", http.StatusConflict},
+		{"Acknowledge duplicates", "acknowledge", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			processed := 0
+			router.POST("/webhooks/:organisation",
+				ReplayGuard(config.Replay{DeliveryTTL: time.Hour, Duplicates: tt.duplicates}),
+				func(c *gin.Context) {
+					processed++
+					c.Status(http.StatusOK)
+				})
+
+			send := func(org, delivery string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest("POST", "/webhooks/"+org, nil)
+				req.Header.Set("X-GitHub-Delivery", delivery)
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			if w := send("demo", "72d3162e"); w.Code != http.StatusOK {
+				t.Fatalf("Expected first delivery to pass, got %d", w.Code)
+			}
+
+			w := send("demo", "72d3162e")
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d for duplicate, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if w := send("other", "72d3162e"); w.Code != http.StatusOK {
+				t.Errorf("Expected same delivery ID for another organisation to pass, got %d", w.Code)
+			}
+
+			if processed != 2 {
+				t.Errorf("Expected 2 processed deliveries, got %d", processed)
+			}
+		})
+	}
+}
+
+func TestReplayGuard_FailedDeliveryCanBeRetried(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	fail := true
+	router.POST("/webhooks/:organisation",
+		ReplayGuard(config.Replay{DeliveryTTL: time.Hour}),
+		func(c *gin.Context) {
+			if fail {
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			c.Status(http.StatusOK)
+		})
+
+	send := func() int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/webhooks/demo", nil)
+		req.Header.Set("X-Gitea-Delivery", "9a1b2c3d")
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := send(); code != http.StatusInternalServerError {
+		t.Fatalf("Expected first delivery to fail, got %d", code)
+	}
+
+	fail = false
+	if code := send(); code != http.StatusOK {
+		t.Errorf("Expected retry of failed delivery to pass, got %d", code)
+	}
+
+	if code := send(); code != http.StatusConflict {
+		t.Errorf("Expected duplicate after success to be rejected, got %d", code)
+	}
+}
+
+func TestDeliveryCache_Expiry(t *testing.T) {
+	cache := newDeliveryCache(time.Minute)
+	now := time.Now()
+
+	if !cache.reserve("demo/1", now) {
+		t.Error("Expected first reservation to succeed")
+	}
+	if cache.reserve("demo/1", now.Add(30*time.Second)) {
+		t.Error("Expected reservation within TTL to fail")
+	}
+	if !cache.reserve("demo/1", now.Add(2*time.Minute)) {
+		t.Error("Expected reservation after TTL to succeed")
+	}
+}
@@ -0,0 +1,16 @@
+package models
+
+// KoanPush is the native payload for plain git servers, posted by
+// `tsuribari notify` from a post-receive hook with X-Koan-Event: push.
+// Before and After are the old and new object names of Ref; After is all
+// zeros when the ref is deleted. Message, the message of After, and
+// PushOptions, those given to `git push -o`, are optional.
+type KoanPush struct {
+	Ref         string   `json:"ref"`
+	Before      string   `json:"before"`
+	After       string   `json:"after"`
+	URL         string   `json:"url"`
+	Org         string   `json:"org"`
+	Message     string   `json:"message,omitempty"`
+	PushOptions []string `json:"push_options,omitempty"`
+}
@@ -1,80 +1,212 @@
 package models
 
 import (
+	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"log"
+	"net/http"
+	"strings"
 	"time"
 )
 
 type Workflow struct {
-	ID    string    `json:"id"`
-	Ref   string    `json:"ref"`
-	URL   string    `json:"url"`
-	Org   string    `json:"org"`
-	Cache string    `json:"cache"`
-	UTC   time.Time `json:"utc"`
+	ID       string    `json:"id"`
+	Ref      string    `json:"ref"`
+	RefName  string    `json:"ref_name,omitempty"`
+	RefType  string    `json:"ref_type,omitempty"`
+	Action   string    `json:"action"`
+	Before   string    `json:"before,omitempty"`
+	Forced   bool      `json:"forced,omitempty"`
+	URL      string    `json:"url"`
+	Org      string    `json:"org"`
+	Pipeline string    `json:"pipeline,omitempty"`
+	Event    string    `json:"event,omitempty"`
+	Cache    string    `json:"cache"`
+	UTC      time.Time `json:"utc"`
+
+	// PullRequest, BaseRef and Fork describe the pull request a workflow
+	// builds, if any. Fork is set when the head repository is not the
+	// base repository, so that consumers can withhold secrets.
+	PullRequest int    `json:"pull_request,omitempty"`
+	BaseRef     string `json:"base_ref,omitempty"`
+	Fork        bool   `json:"fork,omitempty"`
+
+	// Changes lists the paths the pushed commits touch, or is nil when
+	// the sender does not say. Paths is the subset selected by the
+	// pipeline's path rules, published when the pipeline asks for it.
+	Changes []string `json:"-"`
+	Paths   []string `json:"paths,omitempty"`
+
+	// Message is the message of the commit built, and PushOptions those
+	// given to `git push -o`, where the sender reports them. They are
+	// checked for skip markers.
+	Message     string   `json:"-"`
+	PushOptions []string `json:"-"`
 }
 
+// Ref types, derived from the full ref name.
+const (
+	RefTypeBranch      = "branch"
+	RefTypeTag         = "tag"
+	RefTypePullRequest = "pull_request"
+)
+
+// Workflow actions. A delete workflow is for a deleted branch or tag,
+// and its Ref is the commit the ref pointed to.
+const (
+	ActionBuild  = "build"
+	ActionDelete = "delete"
+)
+
+// StatusSkipped marks a stored webhook whose workflows were all filtered
+// out by pipeline rules. SkipReason says which, and SkipMarker holds the
+// skip marker or push option that matched, if any.
+const StatusSkipped = "skipped"
+
+// Publish statuses of a stored webhook's workflows. Pending workflows are
+// published by the outbox dispatcher, which gives up after a number of
+// attempts and marks them failed.
+const (
+	PublishPending   = "pending"
+	PublishPublished = "published"
+	PublishFailed    = "failed"
+)
+
 type WebhookDoc struct {
-	ID      string                 `json:"_id"`
-	UTC     time.Time              `json:"utc"`
-	Headers map[string]string      `json:"headers"`
-	Body    map[string]interface{} `json:"body,omitempty"`
-}
+	ID             string                 `json:"_id"`
+	Rev            string                 `json:"_rev,omitempty"`
+	UTC            time.Time              `json:"utc"`
+	Organisation   string                 `json:"organisation,omitempty"`
+	Pipeline       string                 `json:"pipeline,omitempty"`
+	Provider       string                 `json:"provider,omitempty"`
+	Event          string                 `json:"event,omitempty"`
+	SecretID       string                 `json:"secret_id,omitempty"`
+	DeliveryID     string                 `json:"delivery_id,omitempty"`
+	CorrelationID  string                 `json:"correlation_id,omitempty"`
+	TransformError string                 `json:"transform_error,omitempty"`
+	Status         string                 `json:"status,omitempty"`
+	SkipReason     string                 `json:"skip_reason,omitempty"`
+	SkipMarker     string                 `json:"skip_marker,omitempty"`
+	Headers        map[string]string      `json:"headers"`
+	Body           map[string]interface{} `json:"body,omitempty"`
 
-func TransformWebhookToWorkflow(doc *WebhookDoc) *Workflow {
-	body := doc.Body
+	// Workflows are stored with the webhook, and Published counts those
+	// already sent, so that a retry resumes where the last one failed.
+	Workflows       []*Workflow `json:"workflows,omitempty"`
+	Published       int         `json:"published,omitempty"`
+	PublishStatus   string      `json:"publish_status,omitempty"`
+	PublishAttempts int         `json:"publish_attempts,omitempty"`
+	PublishError    string      `json:"publish_error,omitempty"`
+	NextAttempt     *time.Time  `json:"next_attempt,omitempty"`
 
-	log.Printf("DEBUG: transforming doc ID: %s", doc.ID)
+	// Priority and Expiration, in milliseconds, are set on the messages
+	// of the workflows, unless zero.
+	Priority   uint8  `json:"priority,omitempty"`
+	Expiration string `json:"expiration,omitempty"`
+}
 
-	// Extract repository info (GitHub format)
-	repo, ok := body["repository"].(map[string]interface{})
-	if !ok {
-		log.Printf("DEBUG: has no repository")
-		return nil
+// NewWebhookDoc parses a webhook body received for an organisation and
+// pipeline into a document whose ID is the SHA-1 of all three, so that
+// redeliveries map onto the same document, while the same body sent to
+// several pipelines gives one document, and workflows, for each.
+func NewWebhookDoc(organisation, pipeline string, headers map[string]string, body []byte) (*WebhookDoc, error) {
+	var bodyMap map[string]interface{}
+	if err := json.Unmarshal(body, &bodyMap); err != nil {
+		return nil, err
 	}
 
-	owner, ok := repo["owner"].(map[string]interface{})
-	if !ok {
-		log.Printf("DEBUG: has no owner")
-		return nil
-	}
+	hash := sha1.New()
+	hash.Write([]byte(organisation + "/" + pipeline + "/"))
+	hash.Write(body)
 
-	headCommit, ok := body["head_commit"].(map[string]interface{})
-	if !ok {
-		log.Printf("DEBUG: has no head_commit")
-		return nil
-	}
+	return &WebhookDoc{
+		ID:           hex.EncodeToString(hash.Sum(nil)),
+		UTC:          time.Now().UTC(),
+		Organisation: organisation,
+		Pipeline:     pipeline,
+		Headers:      headers,
+		Body:         bodyMap,
+	}, nil
+}
+
+// secretHeaders carry credentials, such as the organisation's shared
+// secret in X-Gitlab-Token, which must not be stored with the webhook.
+var secretHeaders = map[string]bool{
+	"X-Gitlab-Token":      true,
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
 
-	sshURL, _ := repo["ssh_url"].(string)
-	orgName, _ := owner["login"].(string)
-	commitID, _ := headCommit["id"].(string)
+// Redacted replaces the value of secret headers in stored webhooks.
+const Redacted = "[redacted]"
 
-	log.Printf("DEBUG:  org: '%s', commit: '%s', url: '%s'", orgName, commitID, sshURL)
+// FlattenHeaders keeps the first value of each request header, under its
+// canonical name. Secret headers are kept, to show they were sent, but
+// their value is redacted.
+func FlattenHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string)
+	for name, values := range header {
+		if len(values) == 0 {
+			continue
+		}
+		name = http.CanonicalHeaderKey(name)
+		if secretHeaders[name] {
+			headers[name] = Redacted
+		} else {
+			headers[name] = values[0]
+		}
+	}
+	return headers
+}
 
-	if sshURL == "" || orgName == "" || commitID == "" {
+// NewWorkflow builds a workflow from the fields every transform must
+// find, or returns nil if any of them is empty. The full ref name, such
+// as refs/heads/main, is optional, as not every sender reports it.
+func NewWorkflow(doc *WebhookDoc, ref, refName, url, org string) *Workflow {
+	if url == "" || org == "" || ref == "" {
 		log.Printf("DEBUG: empty fields in webhook body")
 		return nil
 	}
 
 	// Generate cache hash
-	hash := sha256.Sum256([]byte(sshURL))
+	hash := sha256.Sum256([]byte(url))
 	cache := hex.EncodeToString(hash[:])
 
 	workflow := &Workflow{
-		ID:    doc.ID,
-		Ref:   commitID,
-		URL:   sshURL,
-		Org:   orgName,
-		Cache: cache,
-		UTC:   doc.UTC,
+		ID:       doc.ID,
+		Ref:      ref,
+		RefName:  refName,
+		RefType:  RefType(refName),
+		Action:   ActionBuild,
+		URL:      url,
+		Org:      org,
+		Pipeline: doc.Pipeline,
+		Event:    doc.Event,
+		Cache:    cache,
+		UTC:      doc.UTC,
 	}
 
 	log.Printf("INFO: created workflow: %+v", workflow)
 	return workflow
 }
 
+// RefType returns the type of a full ref name: branch, tag or
+// pull_request, or "" if it is none of these.
+func RefType(refName string) string {
+	switch {
+	case strings.HasPrefix(refName, "refs/heads/"):
+		return RefTypeBranch
+	case strings.HasPrefix(refName, "refs/tags/"):
+		return RefTypeTag
+	case strings.HasPrefix(refName, "refs/pull/"), strings.HasPrefix(refName, "refs/merge-requests/"):
+		return RefTypePullRequest
+	}
+	return ""
+}
+
 func getKeys(m map[string]interface{}) []string {
 	keys := make([]string, 0, len(m))
 	for k := range m {
@@ -1,248 +1,87 @@
 package models
 
 import (
+	"net/http"
 	"testing"
 	"time"
 )
 
-func TestTransformWebhookToWorkflow_Success(t *testing.T) {
-	// Create a valid webhook document
+func TestNewWorkflow(t *testing.T) {
 	doc := &WebhookDoc{
-		ID:  "test-doc-id",
-		UTC: time.Now().UTC(),
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-		Body: map[string]interface{}{
-			"repository": map[string]interface{}{
-				"ssh_url": "git@github.com:testorg/testrepo.git",
-				"owner": map[string]interface{}{
-					"login": "testorg",
-				},
-			},
-			"head_commit": map[string]interface{}{
-				"id": "abc123def456789",
-			},
-		},
+		ID:       "test-doc-id",
+		UTC:      time.Now().UTC(),
+		Pipeline: "build",
+		Event:    "push",
 	}
 
-	workflow := TransformWebhookToWorkflow(doc)
-
+	workflow := NewWorkflow(doc, "abc123def456789", "refs/heads/main", "git@github.com:testorg/testrepo.git", "testorg")
 	if workflow == nil {
 		t.Fatal("Expected workflow to be created, got nil")
 	}
 
-	if workflow.ID != "test-doc-id" {
-		t.Errorf("Expected ID 'test-doc-id', got '%s'", workflow.ID)
-	}
-
-	if workflow.Ref != "abc123def456789" {
-		t.Errorf("Expected Ref 'abc123def456789', got '%s'", workflow.Ref)
-	}
-
-	if workflow.URL != "git@github.com:testorg/testrepo.git" {
-		t.Errorf("Expected URL 'git@github.com:testorg/testrepo.git', got '%s'", workflow.URL)
-	}
-
-	if workflow.Org != "testorg" {
-		t.Errorf("Expected Org 'testorg', got '%s'", workflow.Org)
+	// SHA-256 of the URL
+	if workflow.Cache != "13432741816964fa89184f0cf5a74bb81df7df640378155c5abdac49ee2036e4" {
+		t.Errorf("Expected cache to be SHA-256 of URL, got %s", workflow.Cache)
 	}
-
-	if workflow.Cache == "" {
-		t.Error("Expected Cache to be set")
+	if workflow.ID != doc.ID || workflow.UTC != doc.UTC || workflow.Pipeline != "build" || workflow.Event != "push" {
+		t.Errorf("Expected workflow to carry document fields, got %+v", workflow)
 	}
-
-	// Verify cache is SHA256 hash of URL
-	expectedCacheLength := 64 // SHA256 hex string length
-	if len(workflow.Cache) != expectedCacheLength {
-		t.Errorf("Expected cache length %d, got %d", expectedCacheLength, len(workflow.Cache))
+	if workflow.RefName != "refs/heads/main" || workflow.RefType != RefTypeBranch {
+		t.Errorf("Expected branch refs/heads/main, got %s %s", workflow.RefType, workflow.RefName)
 	}
 
-	if workflow.UTC != doc.UTC {
-		t.Error("Expected UTC to match document UTC")
+	if NewWorkflow(doc, "", "refs/heads/main", "git@github.com:testorg/testrepo.git", "testorg") != nil {
+		t.Error("Expected nil workflow when ref is empty")
 	}
 }
 
-func TestTransformWebhookToWorkflow_MissingRepository(t *testing.T) {
-	doc := &WebhookDoc{
-		ID:  "test-doc-id",
-		UTC: time.Now().UTC(),
-		Body: map[string]interface{}{
-			"head_commit": map[string]interface{}{
-				"id": "abc123def456789",
-			},
-		},
+func TestRefType(t *testing.T) {
+	tests := map[string]string{
+		"refs/heads/main":          RefTypeBranch,
+		"refs/heads/feature/login": RefTypeBranch,
+		"refs/tags/v1.0.0":         RefTypeTag,
+		"refs/pull/42/head":        RefTypePullRequest,
+		"refs/merge-requests/7":    RefTypePullRequest,
+		"refs/notes/commits":       "",
+		"":                         "",
 	}
 
-	workflow := TransformWebhookToWorkflow(doc)
-
-	if workflow != nil {
-		t.Error("Expected nil workflow when repository is missing")
+	for refName, expected := range tests {
+		if got := RefType(refName); got != expected {
+			t.Errorf("Expected RefType(%q) to be '%s', got '%s'", refName, expected, got)
+		}
 	}
 }
 
-func TestTransformWebhookToWorkflow_MissingOwner(t *testing.T) {
-	doc := &WebhookDoc{
-		ID:  "test-doc-id",
-		UTC: time.Now().UTC(),
-		Body: map[string]interface{}{
-			"repository": map[string]interface{}{
-				"ssh_url": "git@github.com:testorg/testrepo.git",
-			},
-			"head_commit": map[string]interface{}{
-				"id": "abc123def456789",
-			},
-		},
-	}
-
-	workflow := TransformWebhookToWorkflow(doc)
-
-	if workflow != nil {
-		t.Error("Expected nil workflow when owner is missing")
-	}
-}
+func TestFlattenHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Add("x-github-event", "push")
+	header.Add("X-Forwarded-For", "192.0.2.1")
+	header.Add("X-Forwarded-For", "198.51.100.1")
 
-func TestTransformWebhookToWorkflow_MissingHeadCommit(t *testing.T) {
-	doc := &WebhookDoc{
-		ID:  "test-doc-id",
-		UTC: time.Now().UTC(),
-		Body: map[string]interface{}{
-			"repository": map[string]interface{}{
-				"ssh_url": "git@github.com:testorg/testrepo.git",
-				"owner": map[string]interface{}{
-					"login": "testorg",
-				},
-			},
-		},
+	headers := FlattenHeaders(header)
+	if headers["X-Github-Event"] != "push" {
+		t.Errorf("Expected canonical header name, got %v", headers)
 	}
-
-	workflow := TransformWebhookToWorkflow(doc)
-
-	if workflow != nil {
-		t.Error("Expected nil workflow when head_commit is missing")
+	if headers["X-Forwarded-For"] != "192.0.2.1" {
+		t.Errorf("Expected first value, got %s", headers["X-Forwarded-For"])
 	}
 }
 
-func TestTransformWebhookToWorkflow_EmptyFields(t *testing.T) {
-	tests := []struct {
-		name string
-		body map[string]interface{}
-	}{
-		{
-			name: "Empty SSH URL",
-			body: map[string]interface{}{
-				"repository": map[string]interface{}{
-					"ssh_url": "",
-					"owner": map[string]interface{}{
-						"login": "testorg",
-					},
-				},
-				"head_commit": map[string]interface{}{
-					"id": "abc123def456789",
-				},
-			},
-		},
-		{
-			name: "Empty org name",
-			body: map[string]interface{}{
-				"repository": map[string]interface{}{
-					"ssh_url": "git@github.com:testorg/testrepo.git",
-					"owner": map[string]interface{}{
-						"login": "",
-					},
-				},
-				"head_commit": map[string]interface{}{
-					"id": "abc123def456789",
-				},
-			},
-		},
-		{
-			name: "Empty commit ID",
-			body: map[string]interface{}{
-				"repository": map[string]interface{}{
-					"ssh_url": "git@github.com:testorg/testrepo.git",
-					"owner": map[string]interface{}{
-						"login": "testorg",
-					},
-				},
-				"head_commit": map[string]interface{}{
-					"id": "",
-				},
-			},
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			doc := &WebhookDoc{
-				ID:   "test-doc-id",
-				UTC:  time.Now().UTC(),
-				Body: tt.body,
-			}
-
-			workflow := TransformWebhookToWorkflow(doc)
+func TestFlattenHeaders_RedactsSecrets(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Gitlab-Token", "s3cr3t")
+	header.Set("Authorization", "Bearer s3cr3t")
+	header.Set("X-Gitlab-Event", "Push Hook")
 
-			if workflow != nil {
-				t.Error("Expected nil workflow when required fields are empty")
-			}
-		})
-	}
-}
-
-func TestTransformWebhookToWorkflow_WrongTypes(t *testing.T) {
-	tests := []struct {
-		name string
-		body map[string]interface{}
-	}{
-		{
-			name: "Repository not map",
-			body: map[string]interface{}{
-				"repository": "not a map",
-				"head_commit": map[string]interface{}{
-					"id": "abc123def456789",
-				},
-			},
-		},
-		{
-			name: "Owner not map",
-			body: map[string]interface{}{
-				"repository": map[string]interface{}{
-					"ssh_url": "git@github.com:testorg/testrepo.git",
-					"owner":   "not a map",
-				},
-				"head_commit": map[string]interface{}{
-					"id": "abc123def456789",
-				},
-			},
-		},
-		{
-			name: "Head commit not map",
-			body: map[string]interface{}{
-				"repository": map[string]interface{}{
-					"ssh_url": "git@github.com:testorg/testrepo.git",
-					"owner": map[string]interface{}{
-						"login": "testorg",
-					},
-				},
-				"head_commit": "not a map",
-			},
-		},
+	headers := FlattenHeaders(header)
+	for _, name := range []string{"X-Gitlab-Token", "Authorization"} {
+		if headers[name] != Redacted {
+			t.Errorf("Expected %s to be redacted, got '%s'", name, headers[name])
+		}
 	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			doc := &WebhookDoc{
-				ID:   "test-doc-id",
-				UTC:  time.Now().UTC(),
-				Body: tt.body,
-			}
-
-			workflow := TransformWebhookToWorkflow(doc)
-
-			if workflow != nil {
-				t.Error("Expected nil workflow when fields have wrong types")
-			}
-		})
+	if headers["X-Gitlab-Event"] != "Push Hook" {
+		t.Errorf("Expected X-Gitlab-Event to be kept, got '%s'", headers["X-Gitlab-Event"])
 	}
 }
 
@@ -291,3 +130,43 @@ func TestGetKeys_EmptyMap(t *testing.T) {
 		t.Errorf("Expected 0 keys for empty map, got %d", len(keys))
 	}
 }
+
+func TestNewWebhookDoc(t *testing.T) {
+	body := []byte(`{"head_commit": {"id": "abc123"}}`)
+	headers := map[string]string{"Content-Type": "application/json"}
+
+	doc, err := NewWebhookDoc("acme", "frontend", headers, body)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// SHA-1 of acme/frontend/ followed by the raw body
+	if doc.ID != "c98c362438d1ab768cd43d55a434558312e84109" {
+		t.Errorf("Expected SHA-1 of pipeline and body as ID, got '%s'", doc.ID)
+	}
+	if doc.Organisation != "acme" || doc.Pipeline != "frontend" {
+		t.Errorf("Expected acme/frontend, got %s/%s", doc.Organisation, doc.Pipeline)
+	}
+
+	again, _ := NewWebhookDoc("acme", "frontend", headers, body)
+	if again.ID != doc.ID {
+		t.Error("Expected identical bodies to produce identical IDs")
+	}
+
+	other, _ := NewWebhookDoc("acme", "backend", headers, body)
+	if other.ID == doc.ID {
+		t.Error("Expected the same body for another pipeline to produce another ID")
+	}
+
+	if _, ok := doc.Body["head_commit"]; !ok {
+		t.Error("Expected body to be parsed")
+	}
+
+	if doc.UTC.IsZero() {
+		t.Error("Expected UTC to be set")
+	}
+
+	if _, err := NewWebhookDoc("acme", "frontend", headers, []byte("not json")); err == nil {
+		t.Error("Expected error for invalid JSON body")
+	}
+}
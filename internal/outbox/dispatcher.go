@@ -0,0 +1,193 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"tsuribari/internal/config"
+	"tsuribari/internal/models"
+	"tsuribari/internal/queue"
+)
+
+const (
+	defaultInterval    = 30 * time.Second
+	defaultMinBackoff  = 5 * time.Second
+	defaultMaxBackoff  = 10 * time.Minute
+	defaultMaxAttempts = 20
+
+	// backlog bounds the webhooks waiting for an immediate attempt.
+	// Beyond it, they wait for the next lookup of pending webhooks.
+	backlog = 256
+)
+
+// Storage reads and updates stored webhooks.
+type Storage interface {
+	GetWebhook(id string) (*models.WebhookDoc, error)
+	UpdateWebhook(doc *models.WebhookDoc) error
+	PendingWebhooks() ([]string, error)
+}
+
+// Queue publishes the workflows of a webhook.
+type Queue interface {
+	PublishWorkflow(doc *models.WebhookDoc, workflow *models.Workflow) error
+}
+
+// Dispatcher publishes the workflows of stored webhooks, recording on
+// each webhook how far it got. Webhooks are attempted as soon as they
+// are dispatched, and those still pending are looked up on every
+// interval and retried with exponential backoff.
+type Dispatcher struct {
+	storage     Storage
+	queue       Queue
+	interval    time.Duration
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+
+	ids chan string
+	now func() time.Time
+}
+
+func NewDispatcher(storage Storage, queue Queue, cfg config.Outbox) *Dispatcher {
+	d := &Dispatcher{
+		storage:     storage,
+		queue:       queue,
+		interval:    cfg.Interval,
+		minBackoff:  cfg.MinBackoff,
+		maxBackoff:  cfg.MaxBackoff,
+		maxAttempts: cfg.MaxAttempts,
+		ids:         make(chan string, backlog),
+		now:         time.Now,
+	}
+	if d.interval <= 0 {
+		d.interval = defaultInterval
+	}
+	if d.minBackoff <= 0 {
+		d.minBackoff = defaultMinBackoff
+	}
+	if d.maxBackoff <= 0 {
+		d.maxBackoff = defaultMaxBackoff
+	}
+	if d.maxAttempts <= 0 {
+		d.maxAttempts = defaultMaxAttempts
+	}
+	return d
+}
+
+// Dispatch asks for the workflows of a stored webhook to be published. It
+// does not wait for them.
+func (d *Dispatcher) Dispatch(id string) {
+	select {
+	case d.ids <- id:
+	default:
+		log.Printf("WARN: outbox: backlog full, %s left for the next lookup", id)
+	}
+}
+
+// Run publishes dispatched webhooks and retries pending ones, starting
+// with those left over from a previous run, until the context is
+// cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	d.retry()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-d.ids:
+			d.publish(id)
+		case <-ticker.C:
+			d.retry()
+		}
+	}
+}
+
+// retry publishes the pending webhooks whose next attempt is due.
+func (d *Dispatcher) retry() {
+	ids, err := d.storage.PendingWebhooks()
+	if err != nil {
+		log.Printf("WARN: outbox: cannot look up pending webhooks: %v", err)
+		return
+	}
+	for _, id := range ids {
+		d.publish(id)
+	}
+}
+
+// publish sends the workflows of a webhook not yet published and records
+// the outcome. It does nothing if the webhook is not pending or its next
+// attempt is not due. Attempts made while the broker is unreachable are
+// not counted, so that webhooks outlast an outage of any length.
+func (d *Dispatcher) publish(id string) {
+	doc, err := d.storage.GetWebhook(id)
+	if err != nil {
+		log.Printf("WARN: outbox: cannot read %s: %v", id, err)
+		return
+	}
+	if doc.PublishStatus != models.PublishPending {
+		return
+	}
+	now := d.now()
+	if doc.NextAttempt != nil && now.Before(*doc.NextAttempt) {
+		return
+	}
+
+	err = d.send(doc)
+	disconnected := errors.Is(err, queue.ErrDisconnected)
+	if !disconnected {
+		doc.PublishAttempts++
+	}
+	switch {
+	case err == nil:
+		doc.PublishStatus = models.PublishPublished
+		doc.PublishError = ""
+		doc.NextAttempt = nil
+		log.Printf("INFO: outbox: published %d workflows for %s", len(doc.Workflows), doc.ID)
+	case disconnected:
+		next := now.Add(d.maxBackoff)
+		doc.PublishError = err.Error()
+		doc.NextAttempt = &next
+		log.Printf("WARN: outbox: broker unreachable for %s, retrying at %s", doc.ID, next.Format(time.RFC3339))
+	case doc.PublishAttempts >= d.maxAttempts:
+		doc.PublishStatus = models.PublishFailed
+		doc.PublishError = err.Error()
+		doc.NextAttempt = nil
+		log.Printf("ERROR: outbox: giving up on %s after %d attempts: %v", doc.ID, doc.PublishAttempts, err)
+	default:
+		next := now.Add(d.backoff(doc.PublishAttempts))
+		doc.PublishError = err.Error()
+		doc.NextAttempt = &next
+		log.Printf("WARN: outbox: attempt %d for %s failed, retrying at %s: %v", doc.PublishAttempts, doc.ID, next.Format(time.RFC3339), err)
+	}
+
+	if err := d.storage.UpdateWebhook(doc); err != nil {
+		log.Printf("WARN: outbox: cannot record status of %s: %v", doc.ID, err)
+	}
+}
+
+// send publishes the workflows of a webhook from the first not yet sent.
+func (d *Dispatcher) send(doc *models.WebhookDoc) error {
+	for doc.Published < len(doc.Workflows) {
+		if err := d.queue.PublishWorkflow(doc, doc.Workflows[doc.Published]); err != nil {
+			return err
+		}
+		doc.Published++
+	}
+	return nil
+}
+
+// backoff returns the delay after the given number of failed attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.minBackoff
+	for i := 1; i < attempts && delay < d.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.maxBackoff {
+		delay = d.maxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,222 @@
+package outbox
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"tsuribari/internal/config"
+	"tsuribari/internal/models"
+	"tsuribari/internal/queue"
+)
+
+// Mock storage, keeping webhooks in memory
+type MockStorage struct {
+	docs map[string]*models.WebhookDoc
+}
+
+func (m *MockStorage) GetWebhook(id string) (*models.WebhookDoc, error) {
+	doc, ok := m.docs[id]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	copied := *doc
+	return &copied, nil
+}
+
+func (m *MockStorage) UpdateWebhook(doc *models.WebhookDoc) error {
+	m.docs[doc.ID] = doc
+	return nil
+}
+
+func (m *MockStorage) PendingWebhooks() ([]string, error) {
+	var ids []string
+	for id, doc := range m.docs {
+		if doc.PublishStatus == models.PublishPending {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Mock queue, failing while err is set
+type MockQueue struct {
+	published []string
+	err       error
+}
+
+func (m *MockQueue) PublishWorkflow(doc *models.WebhookDoc, workflow *models.Workflow) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.published = append(m.published, workflow.RefName)
+	return nil
+}
+
+func pendingDoc(id string, refNames ...string) *models.WebhookDoc {
+	doc := &models.WebhookDoc{ID: id, PublishStatus: models.PublishPending}
+	for _, refName := range refNames {
+		doc.Workflows = append(doc.Workflows, &models.Workflow{ID: id, RefName: refName})
+	}
+	return doc
+}
+
+func TestDispatcher_Publish(t *testing.T) {
+	storage := &MockStorage{docs: map[string]*models.WebhookDoc{
+		"a": pendingDoc("a", "refs/heads/main", "refs/tags/v1.0.0"),
+	}}
+	queue := &MockQueue{}
+	d := NewDispatcher(storage, queue, config.Outbox{})
+
+	d.publish("a")
+
+	doc := storage.docs["a"]
+	if doc.PublishStatus != models.PublishPublished {
+		t.Errorf("Expected status published, got %s", doc.PublishStatus)
+	}
+	if doc.PublishAttempts != 1 || doc.Published != 2 {
+		t.Errorf("Expected 2 workflows published in 1 attempt, got %d in %d", doc.Published, doc.PublishAttempts)
+	}
+	if len(queue.published) != 2 {
+		t.Errorf("Expected 2 workflows published, got %v", queue.published)
+	}
+
+	// Published webhooks are not sent again
+	d.publish("a")
+	if len(queue.published) != 2 {
+		t.Errorf("Expected no further workflow published, got %v", queue.published)
+	}
+}
+
+func TestDispatcher_Retry(t *testing.T) {
+	storage := &MockStorage{docs: map[string]*models.WebhookDoc{
+		"a": pendingDoc("a", "refs/heads/main"),
+	}}
+	queue := &MockQueue{err: errors.New("connection refused")}
+	d := NewDispatcher(storage, queue, config.Outbox{MinBackoff: time.Second, MaxBackoff: time.Minute})
+
+	now := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+
+	d.retry()
+
+	doc := storage.docs["a"]
+	if doc.PublishStatus != models.PublishPending || doc.PublishError != "connection refused" {
+		t.Errorf("Expected pending with error, got %s '%s'", doc.PublishStatus, doc.PublishError)
+	}
+	if doc.NextAttempt == nil || !doc.NextAttempt.Equal(now.Add(time.Second)) {
+		t.Errorf("Expected next attempt in 1s, got %v", doc.NextAttempt)
+	}
+
+	// Not retried before the backoff has passed
+	queue.err = nil
+	d.retry()
+	if storage.docs["a"].PublishAttempts != 1 {
+		t.Errorf("Expected 1 attempt before backoff, got %d", storage.docs["a"].PublishAttempts)
+	}
+
+	now = now.Add(time.Second)
+	d.retry()
+
+	doc = storage.docs["a"]
+	if doc.PublishStatus != models.PublishPublished || doc.PublishAttempts != 2 {
+		t.Errorf("Expected published on attempt 2, got %s on %d", doc.PublishStatus, doc.PublishAttempts)
+	}
+	if doc.PublishError != "" || doc.NextAttempt != nil {
+		t.Errorf("Expected error and next attempt cleared, got '%s' %v", doc.PublishError, doc.NextAttempt)
+	}
+}
+
+func TestDispatcher_ResumesPartialPublish(t *testing.T) {
+	storage := &MockStorage{docs: map[string]*models.WebhookDoc{
+		"a": pendingDoc("a", "refs/heads/main", "refs/heads/release"),
+	}}
+	doc := storage.docs["a"]
+	doc.Published = 1
+	queue := &MockQueue{}
+	d := NewDispatcher(storage, queue, config.Outbox{})
+
+	d.publish("a")
+
+	if len(queue.published) != 1 || queue.published[0] != "refs/heads/release" {
+		t.Errorf("Expected only refs/heads/release published, got %v", queue.published)
+	}
+}
+
+func TestDispatcher_GivesUp(t *testing.T) {
+	storage := &MockStorage{docs: map[string]*models.WebhookDoc{
+		"a": pendingDoc("a", "refs/heads/main"),
+	}}
+	queue := &MockQueue{err: errors.New("connection refused")}
+	d := NewDispatcher(storage, queue, config.Outbox{MaxAttempts: 2})
+
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	d.publish("a")
+	now = now.Add(time.Hour)
+	d.publish("a")
+
+	doc := storage.docs["a"]
+	if doc.PublishStatus != models.PublishFailed || doc.PublishAttempts != 2 {
+		t.Errorf("Expected failed after 2 attempts, got %s after %d", doc.PublishStatus, doc.PublishAttempts)
+	}
+
+	if ids, _ := storage.PendingWebhooks(); len(ids) != 0 {
+		t.Errorf("Expected no pending webhook, got %v", ids)
+	}
+}
+
+func TestDispatcher_Disconnected(t *testing.T) {
+	storage := &MockStorage{docs: map[string]*models.WebhookDoc{
+		"a": pendingDoc("a", "refs/heads/main"),
+	}}
+	broker := &MockQueue{err: queue.ErrDisconnected}
+	d := NewDispatcher(storage, broker, config.Outbox{MaxAttempts: 2, MaxBackoff: 10 * time.Minute})
+
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	// An outage outlasting every attempt leaves the webhook pending
+	for i := 0; i < 5; i++ {
+		d.publish("a")
+		now = now.Add(time.Hour)
+	}
+
+	doc := storage.docs["a"]
+	if doc.PublishStatus != models.PublishPending || doc.PublishAttempts != 0 {
+		t.Errorf("Expected pending with no attempt counted, got %s after %d", doc.PublishStatus, doc.PublishAttempts)
+	}
+	if doc.NextAttempt == nil || !doc.NextAttempt.Equal(now.Add(-time.Hour).Add(10*time.Minute)) {
+		t.Errorf("Expected next attempt after the max backoff, got %v", doc.NextAttempt)
+	}
+
+	// Other failures still count towards giving up
+	broker.err = queue.ErrNacked
+	d.publish("a")
+	now = now.Add(time.Hour)
+	d.publish("a")
+
+	doc = storage.docs["a"]
+	if doc.PublishStatus != models.PublishFailed || doc.PublishAttempts != 2 {
+		t.Errorf("Expected failed after 2 attempts, got %s after %d", doc.PublishStatus, doc.PublishAttempts)
+	}
+}
+
+func TestDispatcher_Backoff(t *testing.T) {
+	d := NewDispatcher(&MockStorage{}, &MockQueue{}, config.Outbox{MinBackoff: time.Second, MaxBackoff: 10 * time.Second})
+
+	for attempts, expected := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		4:  8 * time.Second,
+		5:  10 * time.Second,
+		40: 10 * time.Second,
+	} {
+		if got := d.backoff(attempts); got != expected {
+			t.Errorf("Expected backoff %s after %d attempts, got %s", expected, attempts, got)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package providers
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+
+	"tsuribari/internal/models"
+)
+
+// BitbucketCloud adapts Bitbucket Cloud webhooks. Bitbucket Cloud cannot
+// sign, so a shared token may be passed in the URL as ?token= instead.
+type BitbucketCloud struct{}
+
+func (BitbucketCloud) Name() string { return "bitbucket-cloud" }
+
+// Detect relies on X-Hook-UUID, which Data Center does not send.
+func (BitbucketCloud) Detect(header http.Header) bool {
+	return header.Get("X-Event-Key") != "" && header.Get("X-Hook-UUID") != ""
+}
+
+func (BitbucketCloud) Signature(r *http.Request) (Signature, bool) {
+	if signature, found := findSignature(r.Header, hmacSchemes); found {
+		return signature, true
+	}
+	return queryToken(r)
+}
+
+func (BitbucketCloud) Event(header http.Header) string {
+	return header.Get("X-Event-Key")
+}
+
+func (BitbucketCloud) Events() []string { return []string{"repo:push"} }
+
+// Transform maps a repo:push event onto one workflow per updated branch
+// or tag. The payload carries no clone URL, so the SSH URL is derived
+// from the repository's web link.
+func (p BitbucketCloud) Transform(doc *models.WebhookDoc) []*models.Workflow {
+	if event := p.Event(docHeader(doc)); event != "repo:push" {
+		log.Printf("DEBUG: ignoring bitbucket cloud event '%s'", event)
+		return nil
+	}
+
+	repo, ok := doc.Body["repository"].(map[string]interface{})
+	if !ok {
+		log.Printf("DEBUG: has no repository")
+		return nil
+	}
+
+	fullName, _ := repo["full_name"].(string)
+	workspace, _ := repo["workspace"].(map[string]interface{})
+	orgName, _ := workspace["slug"].(string)
+
+	sshURL := ""
+	if host := bitbucketHost(repo); host != "" && fullName != "" {
+		sshURL = "git@" + host + ":" + fullName + ".git"
+	}
+
+	push, _ := doc.Body["push"].(map[string]interface{})
+	changes, _ := push["changes"].([]interface{})
+
+	var workflows []*models.Workflow
+	for _, c := range changes {
+		change, _ := c.(map[string]interface{})
+
+		// old is null when a branch or tag is created, and new when
+		// it is deleted
+		oldRef, _ := change["old"].(map[string]interface{})
+		oldTarget, _ := oldRef["target"].(map[string]interface{})
+		before, _ := oldTarget["hash"].(string)
+
+		newRef, ok := change["new"].(map[string]interface{})
+		if !ok {
+			if workflow := deletion(doc, before, bitbucketRefName(oldRef), sshURL, orgName); workflow != nil {
+				workflows = append(workflows, workflow)
+			}
+			continue
+		}
+		target, _ := newRef["target"].(map[string]interface{})
+		commitID, _ := target["hash"].(string)
+		refName := bitbucketRefName(newRef)
+
+		log.Printf("DEBUG:  org: '%s', commit: '%s', url: '%s'", orgName, commitID, sshURL)
+
+		if workflow := models.NewWorkflow(doc, commitID, refName, sshURL, orgName); workflow != nil {
+			workflow.Before = before
+			workflow.Forced, _ = change["forced"].(bool)
+			workflow.Message, _ = target["message"].(string)
+			workflows = append(workflows, workflow)
+		}
+	}
+	return workflows
+}
+
+// BitbucketDataCenter adapts Bitbucket Data Center webhooks, signed
+// with X-Hub-Signature.
+type BitbucketDataCenter struct{}
+
+func (BitbucketDataCenter) Name() string { return "bitbucket-datacenter" }
+
+func (BitbucketDataCenter) Detect(header http.Header) bool {
+	return header.Get("X-Event-Key") != ""
+}
+
+func (BitbucketDataCenter) Signature(r *http.Request) (Signature, bool) {
+	return findSignature(r.Header, hmacSchemes)
+}
+
+func (BitbucketDataCenter) Event(header http.Header) string {
+	return header.Get("X-Event-Key")
+}
+
+func (BitbucketDataCenter) Events() []string { return []string{"repo:refs_changed"} }
+
+// Transform maps a repo:refs_changed event onto one workflow per
+// updated ref.
+func (p BitbucketDataCenter) Transform(doc *models.WebhookDoc) []*models.Workflow {
+	if event := p.Event(docHeader(doc)); event != "repo:refs_changed" {
+		log.Printf("DEBUG: ignoring bitbucket data center event '%s'", event)
+		return nil
+	}
+
+	repo, ok := doc.Body["repository"].(map[string]interface{})
+	if !ok {
+		log.Printf("DEBUG: has no repository")
+		return nil
+	}
+
+	project, _ := repo["project"].(map[string]interface{})
+	orgName, _ := project["key"].(string)
+	sshURL := bitbucketCloneURL(repo, "ssh")
+
+	changes, _ := doc.Body["changes"].([]interface{})
+
+	var workflows []*models.Workflow
+	for _, c := range changes {
+		change, _ := c.(map[string]interface{})
+		commitID, _ := change["toHash"].(string)
+		before, _ := change["fromHash"].(string)
+		ref, _ := change["ref"].(map[string]interface{})
+		refName, _ := ref["id"].(string)
+
+		if changeType, _ := change["type"].(string); changeType == "DELETE" {
+			if workflow := deletion(doc, before, refName, sshURL, orgName); workflow != nil {
+				workflows = append(workflows, workflow)
+			}
+			continue
+		}
+
+		log.Printf("DEBUG:  org: '%s', commit: '%s', url: '%s'", orgName, commitID, sshURL)
+
+		if workflow := models.NewWorkflow(doc, commitID, refName, sshURL, orgName); workflow != nil {
+			workflow.Before = nonZeroSHA(before)
+			workflows = append(workflows, workflow)
+		}
+	}
+	return workflows
+}
+
+// bitbucketHost returns the host of a Bitbucket Cloud repository's
+// links.html.href.
+func bitbucketHost(repo map[string]interface{}) string {
+	links, _ := repo["links"].(map[string]interface{})
+	html, _ := links["html"].(map[string]interface{})
+	href, _ := html["href"].(string)
+
+	u, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// bitbucketRefName returns the full name of a Bitbucket Cloud branch or
+// tag, which the payload gives as a type and a short name.
+func bitbucketRefName(ref map[string]interface{}) string {
+	name, _ := ref["name"].(string)
+	if name == "" {
+		return ""
+	}
+	switch refType, _ := ref["type"].(string); refType {
+	case "branch":
+		return "refs/heads/" + name
+	case "tag":
+		return "refs/tags/" + name
+	}
+	return ""
+}
+
+// bitbucketCloneURL returns the Data Center clone link with the given
+// name, such as "ssh" or "http".
+func bitbucketCloneURL(repo map[string]interface{}, name string) string {
+	links, _ := repo["links"].(map[string]interface{})
+	clones, _ := links["clone"].([]interface{})
+	for _, c := range clones {
+		clone, _ := c.(map[string]interface{})
+		if cloneName, _ := clone["name"].(string); cloneName == name {
+			href, _ := clone["href"].(string)
+			return href
+		}
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package providers
+
+import (
+	"testing"
+
+	"tsuribari/internal/models"
+)
+
+func TestBitbucketCloud(t *testing.T) {
+	doc := loadFixture(t, "webhook_bitbucket_cloud_push.json", map[string]string{
+		"X-Event-Key": "repo:push",
+		"X-Hook-Uuid": "b4a6c1d2-3e4f-4a5b-8c6d-7e8f9a0b1c2d",
+	})
+
+	workflows := transform(doc)
+	if len(workflows) != 3 {
+		t.Fatalf("Expected 3 workflows, got %d", len(workflows))
+	}
+
+	for _, workflow := range workflows[:2] {
+		if workflow.Ref != "709d658dc5b6d6afcd46049c2f332ee3f515a67d" {
+			t.Errorf("Expected Ref '709d658dc5b6d6afcd46049c2f332ee3f515a67d', got '%s'", workflow.Ref)
+		}
+		if workflow.URL != "git@bitbucket.org:skunkwerks/tsuribari.git" {
+			t.Errorf("Expected URL 'git@bitbucket.org:skunkwerks/tsuribari.git', got '%s'", workflow.URL)
+		}
+		if workflow.Org != "skunkwerks" {
+			t.Errorf("Expected Org 'skunkwerks', got '%s'", workflow.Org)
+		}
+	}
+
+	if workflows[0].RefName != "refs/heads/main" || workflows[1].RefName != "refs/tags/v1.2.0" {
+		t.Errorf("Expected refs/heads/main and refs/tags/v1.2.0, got %s and %s", workflows[0].RefName, workflows[1].RefName)
+	}
+	if workflows[1].RefType != models.RefTypeTag {
+		t.Errorf("Expected RefType 'tag', got '%s'", workflows[1].RefType)
+	}
+	if workflows[0].Before != "1e65c05c1d5171631d92438a13901ca7dae9618c" || workflows[1].Before != "" {
+		t.Errorf("Expected Before of the updated branch only, got '%s' and '%s'", workflows[0].Before, workflows[1].Before)
+	}
+
+	deleted := workflows[2]
+	if deleted.Action != models.ActionDelete || deleted.RefName != "refs/heads/feature/old" {
+		t.Errorf("Expected refs/heads/feature/old to be deleted, got %s %s", deleted.Action, deleted.RefName)
+	}
+	if deleted.Ref != "3c2a1b0f9e8d7c6b5a4938271605f4e3d2c1b0a9" {
+		t.Errorf("Expected Ref of the deleted branch's last commit, got '%s'", deleted.Ref)
+	}
+}
+
+func TestBitbucketDataCenter(t *testing.T) {
+	doc := loadFixture(t, "webhook_bitbucket_datacenter_refs_changed.json", map[string]string{
+		"X-Event-Key": "repo:refs_changed",
+	})
+
+	workflows := transform(doc)
+	if len(workflows) != 3 {
+		t.Fatalf("Expected 3 workflows, got %d", len(workflows))
+	}
+
+	for _, workflow := range workflows[:2] {
+		if workflow.Ref != "178864a7d521b6f5e720b386b2c2b0ef8563e0dc" {
+			t.Errorf("Expected Ref '178864a7d521b6f5e720b386b2c2b0ef8563e0dc', got '%s'", workflow.Ref)
+		}
+		if workflow.URL != "ssh://git@bitbucket.example:7999/sw/tsuribari.git" {
+			t.Errorf("Expected URL 'ssh://git@bitbucket.example:7999/sw/tsuribari.git', got '%s'", workflow.URL)
+		}
+		if workflow.Org != "SW" {
+			t.Errorf("Expected Org 'SW', got '%s'", workflow.Org)
+		}
+	}
+
+	if workflows[0].RefName != "refs/heads/main" || workflows[1].RefName != "refs/heads/release" {
+		t.Errorf("Expected refs/heads/main and refs/heads/release, got %s and %s", workflows[0].RefName, workflows[1].RefName)
+	}
+
+	deleted := workflows[2]
+	if deleted.Action != models.ActionDelete || deleted.RefName != "refs/heads/feature/old" {
+		t.Errorf("Expected refs/heads/feature/old to be deleted, got %s %s", deleted.Action, deleted.RefName)
+	}
+	if deleted.Ref != "ecddabb624f6f5ba43816f5926e580a5f680a932" {
+		t.Errorf("Expected Ref of the deleted branch's last commit, got '%s'", deleted.Ref)
+	}
+}
+
+func TestBitbucketIgnored(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		headers map[string]string
+	}{
+		{
+			name:    "Cloud pull request",
+			fixture: "webhook_bitbucket_cloud_push.json",
+			headers: map[string]string{
+				"X-Event-Key": "pullrequest:created",
+				"X-Hook-Uuid": "b4a6c1d2-3e4f-4a5b-8c6d-7e8f9a0b1c2d",
+			},
+		},
+		{
+			name:    "Data Center ping",
+			fixture: "webhook_bitbucket_datacenter_refs_changed.json",
+			headers: map[string]string{"X-Event-Key": "diagnostics:ping"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := loadFixture(t, tt.fixture, tt.headers)
+
+			if workflows := transform(doc); len(workflows) != 0 {
+				t.Errorf("Expected no workflows, got %d", len(workflows))
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package providers
+
+import (
+	"log"
+	"net/http"
+
+	"tsuribari/internal/models"
+)
+
+// Forgejo adapts Forgejo and Gitea webhooks, which are signed with a bare
+// hex HMAC-SHA256 digest.
+type Forgejo struct{}
+
+var forgejoSchemes = append([]SignatureScheme{
+	{Header: "X-Gitea-Signature", Parse: parseHexSHA256},
+	{Header: "X-Forgejo-Signature", Parse: parseHexSHA256},
+}, hmacSchemes...)
+
+func (Forgejo) Name() string { return "forgejo" }
+
+// Detect must run before GitHub's, since both also send X-GitHub-Event.
+func (Forgejo) Detect(header http.Header) bool {
+	return header.Get("X-Forgejo-Event") != "" || header.Get("X-Gitea-Event") != "" ||
+		header.Get("X-Forgejo-Signature") != "" || header.Get("X-Gitea-Signature") != ""
+}
+
+func (Forgejo) Signature(r *http.Request) (Signature, bool) {
+	return findSignature(r.Header, forgejoSchemes)
+}
+
+func (Forgejo) Event(header http.Header) string {
+	if event := header.Get("X-Forgejo-Event"); event != "" {
+		return event
+	}
+	return header.Get("X-Gitea-Event")
+}
+
+func (Forgejo) Events() []string { return []string{"push"} }
+
+// Transform maps push events onto a workflow. The body resembles
+// GitHub's, but head_commit may be null, and older Gitea releases only
+// fill in owner.username.
+func (p Forgejo) Transform(doc *models.WebhookDoc) []*models.Workflow {
+	if event := p.Event(docHeader(doc)); event != "push" {
+		log.Printf("DEBUG: ignoring forgejo event '%s'", event)
+		return nil
+	}
+
+	repo, ok := doc.Body["repository"].(map[string]interface{})
+	if !ok {
+		log.Printf("DEBUG: has no repository")
+		return nil
+	}
+
+	owner, ok := repo["owner"].(map[string]interface{})
+	if !ok {
+		log.Printf("DEBUG: has no owner")
+		return nil
+	}
+
+	sshURL, _ := repo["ssh_url"].(string)
+	orgName, _ := owner["login"].(string)
+	if orgName == "" {
+		orgName, _ = owner["username"].(string)
+	}
+	commitID, _ := doc.Body["after"].(string)
+	refName, _ := doc.Body["ref"].(string)
+	before, _ := doc.Body["before"].(string)
+
+	if isZeroSHA(commitID) {
+		return single(deletion(doc, before, refName, sshURL, orgName))
+	}
+
+	log.Printf("DEBUG:  org: '%s', commit: '%s', url: '%s'", orgName, commitID, sshURL)
+
+	workflow := models.NewWorkflow(doc, commitID, refName, sshURL, orgName)
+	if workflow == nil {
+		return nil
+	}
+	workflow.Before = nonZeroSHA(before)
+	workflow.Changes = changedPaths(doc.Body)
+	workflow.Message = commitMessage(doc.Body, commitID)
+	return single(workflow)
+}
@@ -0,0 +1,114 @@
+package providers
+
+import (
+	"testing"
+
+	"tsuribari/internal/models"
+)
+
+func TestForgejo(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+	}{
+		{
+			name: "Forgejo",
+			headers: map[string]string{
+				"X-Forgejo-Event": "push",
+				"X-Gitea-Event":   "push",
+				"X-GitHub-Event":  "push",
+			},
+		},
+		{
+			name: "Gitea",
+			headers: map[string]string{
+				"X-Gitea-Event":  "push",
+				"X-GitHub-Event": "push",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := loadFixture(t, "webhook_forgejo_push.json", tt.headers)
+
+			workflow := transformOne(t, doc)
+			if workflow == nil {
+				t.Fatal("Expected workflow to be created, got nil")
+			}
+
+			if workflow.Ref != "bffeb74224043ba2feb48d137756c8a9331c449a" {
+				t.Errorf("Expected Ref 'bffeb74224043ba2feb48d137756c8a9331c449a', got '%s'", workflow.Ref)
+			}
+			if workflow.RefName != "refs/heads/main" {
+				t.Errorf("Expected RefName 'refs/heads/main', got '%s'", workflow.RefName)
+			}
+			if workflow.URL != "git@codeberg.example:skunkwerks/tsuribari.git" {
+				t.Errorf("Expected URL 'git@codeberg.example:skunkwerks/tsuribari.git', got '%s'", workflow.URL)
+			}
+			if workflow.Org != "skunkwerks" {
+				t.Errorf("Expected Org 'skunkwerks', got '%s'", workflow.Org)
+			}
+		})
+	}
+}
+
+func TestForgejoUsernameOnly(t *testing.T) {
+	doc := &models.WebhookDoc{
+		ID:      "test-doc-id",
+		Headers: map[string]string{"X-Gitea-Event": "push"},
+		Body: map[string]interface{}{
+			"after":       "bffeb74224043ba2feb48d137756c8a9331c449a",
+			"head_commit": nil,
+			"repository": map[string]interface{}{
+				"ssh_url": "git@gitea.example:old/repo.git",
+				"owner": map[string]interface{}{
+					"username": "old",
+				},
+			},
+		},
+	}
+
+	workflow := transformOne(t, doc)
+	if workflow == nil {
+		t.Fatal("Expected workflow to be created, got nil")
+	}
+	if workflow.Org != "old" {
+		t.Errorf("Expected Org 'old', got '%s'", workflow.Org)
+	}
+}
+
+func TestForgejoDeleted(t *testing.T) {
+	doc := loadFixture(t, "webhook_forgejo_push.json", map[string]string{"X-Forgejo-Event": "push"})
+	doc.Body["after"] = "0000000000000000000000000000000000000000"
+	doc.Body["head_commit"] = nil
+	doc.Body["commits"] = []interface{}{}
+
+	workflow := transformOne(t, doc)
+	if workflow == nil {
+		t.Fatal("Expected workflow to be created, got nil")
+	}
+	if workflow.Action != models.ActionDelete || workflow.RefName != "refs/heads/main" {
+		t.Errorf("Expected refs/heads/main to be deleted, got %s %s", workflow.Action, workflow.RefName)
+	}
+	if workflow.Ref != "28e1879d029cb852e4844d9c718537df08844e03" {
+		t.Errorf("Expected Ref of the deleted branch's last commit, got '%s'", workflow.Ref)
+	}
+}
+
+func TestForgejoIgnored(t *testing.T) {
+	doc := &models.WebhookDoc{
+		ID:      "test-doc-id",
+		Headers: map[string]string{"X-Forgejo-Event": "issues"},
+		Body: map[string]interface{}{
+			"repository": map[string]interface{}{
+				"ssh_url": "git@codeberg.example:skunkwerks/tsuribari.git",
+				"owner":   map[string]interface{}{"login": "skunkwerks"},
+			},
+		},
+	}
+
+	if workflow := transformOne(t, doc); workflow != nil {
+		t.Errorf("Expected nil workflow, got %+v", workflow)
+	}
+}
@@ -0,0 +1,167 @@
+package providers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"tsuribari/internal/models"
+)
+
+// GitHub adapts GitHub webhooks. It is the fallback provider, so it also
+// handles senders that imitate GitHub without identifying themselves.
+type GitHub struct{}
+
+func (GitHub) Name() string { return "github" }
+
+func (GitHub) Detect(header http.Header) bool {
+	return header.Get("X-GitHub-Event") != ""
+}
+
+func (GitHub) Signature(r *http.Request) (Signature, bool) {
+	return findSignature(r.Header, hmacSchemes)
+}
+
+func (GitHub) Event(header http.Header) string {
+	return header.Get("X-GitHub-Event")
+}
+
+// Events lists pushes only: pull requests, which may come from forks,
+// are built only where an organisation or pipeline lists them.
+func (GitHub) Events() []string { return []string{"push"} }
+
+// Transform maps pushes and pull requests onto a workflow. Requests
+// without an event header are taken to be pushes.
+func (p GitHub) Transform(doc *models.WebhookDoc) []*models.Workflow {
+	switch event := p.Event(docHeader(doc)); event {
+	case "", "push":
+		return single(githubPush(doc))
+	case "pull_request":
+		return single(githubPullRequest(doc))
+	default:
+		log.Printf("DEBUG: ignoring github event '%s'", event)
+		return nil
+	}
+}
+
+// githubPush builds a push workflow, using the head commit as ref.
+func githubPush(doc *models.WebhookDoc) *models.Workflow {
+	body := doc.Body
+
+	// Extract repository info (GitHub format)
+	repo, ok := body["repository"].(map[string]interface{})
+	if !ok {
+		log.Printf("DEBUG: has no repository")
+		return nil
+	}
+
+	owner, ok := repo["owner"].(map[string]interface{})
+	if !ok {
+		log.Printf("DEBUG: has no owner")
+		return nil
+	}
+
+	sshURL, _ := repo["ssh_url"].(string)
+	orgName, _ := owner["login"].(string)
+	refName, _ := body["ref"].(string)
+	before, _ := body["before"].(string)
+
+	// A deleted ref has no head commit
+	if deleted, _ := body["deleted"].(bool); deleted {
+		return deletion(doc, before, refName, sshURL, orgName)
+	}
+
+	headCommit, ok := body["head_commit"].(map[string]interface{})
+	if !ok {
+		log.Printf("DEBUG: has no head_commit")
+		return nil
+	}
+
+	commitID, _ := headCommit["id"].(string)
+
+	log.Printf("DEBUG:  org: '%s', commit: '%s', url: '%s'", orgName, commitID, sshURL)
+
+	workflow := models.NewWorkflow(doc, commitID, refName, sshURL, orgName)
+	if workflow == nil {
+		return nil
+	}
+	workflow.Before = nonZeroSHA(before)
+	workflow.Forced, _ = body["forced"].(bool)
+	workflow.Changes = changedPaths(body)
+	workflow.Message = commitMessage(body, commitID)
+	return workflow
+}
+
+// githubPullRequest builds a workflow for the head of a pull request
+// that was opened, reopened or pushed to. The URL is that of the head
+// repository, which is a fork when the pull request comes from one, and
+// the org is the owner of the base repository.
+func githubPullRequest(doc *models.WebhookDoc) *models.Workflow {
+	switch action, _ := doc.Body["action"].(string); action {
+	case "opened", "synchronize", "reopened":
+	default:
+		log.Printf("DEBUG: ignoring pull_request action '%s'", action)
+		return nil
+	}
+
+	pr, ok := doc.Body["pull_request"].(map[string]interface{})
+	if !ok {
+		log.Printf("DEBUG: has no pull_request")
+		return nil
+	}
+
+	head, _ := pr["head"].(map[string]interface{})
+	base, _ := pr["base"].(map[string]interface{})
+	if head == nil || base == nil {
+		log.Printf("DEBUG: has no head or base")
+		return nil
+	}
+
+	// The head repository is null when the fork has been deleted
+	headRepo, ok := head["repo"].(map[string]interface{})
+	if !ok {
+		log.Printf("DEBUG: has no head repository")
+		return nil
+	}
+	baseRepo, ok := base["repo"].(map[string]interface{})
+	if !ok {
+		log.Printf("DEBUG: has no base repository")
+		return nil
+	}
+	owner, ok := baseRepo["owner"].(map[string]interface{})
+	if !ok {
+		log.Printf("DEBUG: has no owner")
+		return nil
+	}
+
+	sshURL, _ := headRepo["ssh_url"].(string)
+	orgName, _ := owner["login"].(string)
+	commitID, _ := head["sha"].(string)
+
+	log.Printf("DEBUG:  org: '%s', commit: '%s', url: '%s'", orgName, commitID, sshURL)
+
+	// GitHub keeps the head of every pull request under refs/pull
+	number, _ := pr["number"].(float64)
+	refName := fmt.Sprintf("refs/pull/%d/head", int(number))
+
+	workflow := models.NewWorkflow(doc, commitID, refName, sshURL, orgName)
+	if workflow == nil {
+		return nil
+	}
+
+	headName, _ := headRepo["full_name"].(string)
+	baseName, _ := baseRepo["full_name"].(string)
+
+	workflow.PullRequest = int(number)
+	workflow.BaseRef, _ = base["ref"].(string)
+	workflow.Fork = headName != baseName
+	return workflow
+}
+
+// single wraps the workflow of a transform that finds at most one.
+func single(workflow *models.Workflow) []*models.Workflow {
+	if workflow == nil {
+		return nil
+	}
+	return []*models.Workflow{workflow}
+}
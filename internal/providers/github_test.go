@@ -0,0 +1,423 @@
+package providers
+
+import (
+	"testing"
+	"time"
+
+	"tsuribari/internal/models"
+)
+
+func TestGitHub_Success(t *testing.T) {
+	// Create a valid webhook document
+	doc := &models.WebhookDoc{
+		ID:  "test-doc-id",
+		UTC: time.Now().UTC(),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: map[string]interface{}{
+			"repository": map[string]interface{}{
+				"ssh_url": "git@github.com:testorg/testrepo.git",
+				"owner": map[string]interface{}{
+					"login": "testorg",
+				},
+			},
+			"head_commit": map[string]interface{}{
+				"id": "abc123def456789",
+			},
+		},
+	}
+
+	workflow := transformOne(t, doc)
+
+	if workflow == nil {
+		t.Fatal("Expected workflow to be created, got nil")
+	}
+
+	if workflow.ID != "test-doc-id" {
+		t.Errorf("Expected ID 'test-doc-id', got '%s'", workflow.ID)
+	}
+
+	if workflow.Ref != "abc123def456789" {
+		t.Errorf("Expected Ref 'abc123def456789', got '%s'", workflow.Ref)
+	}
+
+	if workflow.URL != "git@github.com:testorg/testrepo.git" {
+		t.Errorf("Expected URL 'git@github.com:testorg/testrepo.git', got '%s'", workflow.URL)
+	}
+
+	if workflow.Org != "testorg" {
+		t.Errorf("Expected Org 'testorg', got '%s'", workflow.Org)
+	}
+
+	if workflow.Cache == "" {
+		t.Error("Expected Cache to be set")
+	}
+
+	// Verify cache is SHA256 hash of URL
+	expectedCacheLength := 64 // SHA256 hex string length
+	if len(workflow.Cache) != expectedCacheLength {
+		t.Errorf("Expected cache length %d, got %d", expectedCacheLength, len(workflow.Cache))
+	}
+
+	if workflow.UTC != doc.UTC {
+		t.Error("Expected UTC to match document UTC")
+	}
+}
+
+func TestGitHub_MissingRepository(t *testing.T) {
+	doc := &models.WebhookDoc{
+		ID:  "test-doc-id",
+		UTC: time.Now().UTC(),
+		Body: map[string]interface{}{
+			"head_commit": map[string]interface{}{
+				"id": "abc123def456789",
+			},
+		},
+	}
+
+	workflow := transformOne(t, doc)
+
+	if workflow != nil {
+		t.Error("Expected nil workflow when repository is missing")
+	}
+}
+
+func TestGitHub_MissingOwner(t *testing.T) {
+	doc := &models.WebhookDoc{
+		ID:  "test-doc-id",
+		UTC: time.Now().UTC(),
+		Body: map[string]interface{}{
+			"repository": map[string]interface{}{
+				"ssh_url": "git@github.com:testorg/testrepo.git",
+			},
+			"head_commit": map[string]interface{}{
+				"id": "abc123def456789",
+			},
+		},
+	}
+
+	workflow := transformOne(t, doc)
+
+	if workflow != nil {
+		t.Error("Expected nil workflow when owner is missing")
+	}
+}
+
+func TestGitHub_MissingHeadCommit(t *testing.T) {
+	doc := &models.WebhookDoc{
+		ID:  "test-doc-id",
+		UTC: time.Now().UTC(),
+		Body: map[string]interface{}{
+			"repository": map[string]interface{}{
+				"ssh_url": "git@github.com:testorg/testrepo.git",
+				"owner": map[string]interface{}{
+					"login": "testorg",
+				},
+			},
+		},
+	}
+
+	workflow := transformOne(t, doc)
+
+	if workflow != nil {
+		t.Error("Expected nil workflow when head_commit is missing")
+	}
+}
+
+func TestGitHub_EmptyFields(t *testing.T) {
+	tests := []struct {
+		name string
+		body map[string]interface{}
+	}{
+		{
+			name: "Empty SSH URL",
+			body: map[string]interface{}{
+				"repository": map[string]interface{}{
+					"ssh_url": "",
+					"owner": map[string]interface{}{
+						"login": "testorg",
+					},
+				},
+				"head_commit": map[string]interface{}{
+					"id": "abc123def456789",
+				},
+			},
+		},
+		{
+			name: "Empty org name",
+			body: map[string]interface{}{
+				"repository": map[string]interface{}{
+					"ssh_url": "git@github.com:testorg/testrepo.git",
+					"owner": map[string]interface{}{
+						"login": "",
+					},
+				},
+				"head_commit": map[string]interface{}{
+					"id": "abc123def456789",
+				},
+			},
+		},
+		{
+			name: "Empty commit ID",
+			body: map[string]interface{}{
+				"repository": map[string]interface{}{
+					"ssh_url": "git@github.com:testorg/testrepo.git",
+					"owner": map[string]interface{}{
+						"login": "testorg",
+					},
+				},
+				"head_commit": map[string]interface{}{
+					"id": "",
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := &models.WebhookDoc{
+				ID:   "test-doc-id",
+				UTC:  time.Now().UTC(),
+				Body: tt.body,
+			}
+
+			workflow := transformOne(t, doc)
+
+			if workflow != nil {
+				t.Error("Expected nil workflow when required fields are empty")
+			}
+		})
+	}
+}
+
+func TestGitHub_WrongTypes(t *testing.T) {
+	tests := []struct {
+		name string
+		body map[string]interface{}
+	}{
+		{
+			name: "Repository not map",
+			body: map[string]interface{}{
+				"repository": "not a map",
+				"head_commit": map[string]interface{}{
+					"id": "abc123def456789",
+				},
+			},
+		},
+		{
+			name: "Owner not map",
+			body: map[string]interface{}{
+				"repository": map[string]interface{}{
+					"ssh_url": "git@github.com:testorg/testrepo.git",
+					"owner":   "not a map",
+				},
+				"head_commit": map[string]interface{}{
+					"id": "abc123def456789",
+				},
+			},
+		},
+		{
+			name: "Head commit not map",
+			body: map[string]interface{}{
+				"repository": map[string]interface{}{
+					"ssh_url": "git@github.com:testorg/testrepo.git",
+					"owner": map[string]interface{}{
+						"login": "testorg",
+					},
+				},
+				"head_commit": "not a map",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := &models.WebhookDoc{
+				ID:   "test-doc-id",
+				UTC:  time.Now().UTC(),
+				Body: tt.body,
+			}
+
+			workflow := transformOne(t, doc)
+
+			if workflow != nil {
+				t.Error("Expected nil workflow when fields have wrong types")
+			}
+		})
+	}
+}
+
+func TestGitHub_RefName(t *testing.T) {
+	doc := loadFixture(t, "webhook_github.json", map[string]string{"X-Github-Event": "push"})
+
+	workflow := transformOne(t, doc)
+	if workflow == nil {
+		t.Fatal("Expected workflow to be created, got nil")
+	}
+	if workflow.RefName != "refs/heads/master" || workflow.RefType != models.RefTypeBranch {
+		t.Errorf("Expected branch refs/heads/master, got %s %s", workflow.RefType, workflow.RefName)
+	}
+}
+
+func TestGitHub_Deleted(t *testing.T) {
+	doc := loadFixture(t, "webhook_github_delete.json", map[string]string{"X-Github-Event": "push"})
+
+	workflow := transformOne(t, doc)
+	if workflow == nil {
+		t.Fatal("Expected workflow to be created, got nil")
+	}
+
+	if workflow.Action != models.ActionDelete {
+		t.Errorf("Expected Action 'delete', got '%s'", workflow.Action)
+	}
+	if workflow.Ref != "9049f1265b7d61be4a8904a9a27120d2064dab3b" || workflow.Before != workflow.Ref {
+		t.Errorf("Expected Ref and Before of the deleted branch's last commit, got '%s' and '%s'", workflow.Ref, workflow.Before)
+	}
+	if workflow.RefName != "refs/heads/feature/old" {
+		t.Errorf("Expected RefName 'refs/heads/feature/old', got '%s'", workflow.RefName)
+	}
+	if workflow.URL != "git@github.com:baxterthehacker/public-repo.git" {
+		t.Errorf("Expected URL 'git@github.com:baxterthehacker/public-repo.git', got '%s'", workflow.URL)
+	}
+}
+
+func TestGitHub_Forced(t *testing.T) {
+	tests := []struct {
+		name   string
+		before string
+		forced bool
+		want   string
+	}{
+		{"Forced", "9049f1265b7d61be4a8904a9a27120d2064dab3b", true, "9049f1265b7d61be4a8904a9a27120d2064dab3b"},
+		{"New branch", "0000000000000000000000000000000000000000", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := loadFixture(t, "webhook_github.json", map[string]string{"X-Github-Event": "push"})
+			doc.Body["before"] = tt.before
+			doc.Body["forced"] = tt.forced
+
+			workflow := transformOne(t, doc)
+			if workflow == nil {
+				t.Fatal("Expected workflow to be created, got nil")
+			}
+			if workflow.Action != models.ActionBuild {
+				t.Errorf("Expected Action 'build', got '%s'", workflow.Action)
+			}
+			if workflow.Forced != tt.forced {
+				t.Errorf("Expected Forced %v, got %v", tt.forced, workflow.Forced)
+			}
+			if workflow.Before != tt.want {
+				t.Errorf("Expected Before '%s', got '%s'", tt.want, workflow.Before)
+			}
+		})
+	}
+}
+
+func TestGitHub_Events(t *testing.T) {
+	tests := []struct {
+		event string
+		built bool
+	}{
+		{"push", true},
+		{"", true},
+		{"create", false},
+		{"release", false},
+		{"ping", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.event, func(t *testing.T) {
+			headers := map[string]string{}
+			if tt.event != "" {
+				headers["X-Github-Event"] = tt.event
+			}
+			doc := loadFixture(t, "webhook_github.json", headers)
+
+			if workflow := transformOne(t, doc); (workflow != nil) != tt.built {
+				t.Errorf("Expected workflow built %v for event '%s', got %+v", tt.built, tt.event, workflow)
+			}
+		})
+	}
+}
+
+func TestGitHub_PullRequest(t *testing.T) {
+	doc := loadFixture(t, "webhook_github_pull_request.json", map[string]string{"X-Github-Event": "pull_request"})
+
+	workflow := transformOne(t, doc)
+	if workflow == nil {
+		t.Fatal("Expected workflow to be created, got nil")
+	}
+
+	if workflow.Ref != "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c" {
+		t.Errorf("Expected Ref of the head commit, got '%s'", workflow.Ref)
+	}
+	if workflow.URL != "git@github.com:octocat/public-repo.git" {
+		t.Errorf("Expected URL of the head repository, got '%s'", workflow.URL)
+	}
+	if workflow.Org != "baxterthehacker" {
+		t.Errorf("Expected Org of the base repository, got '%s'", workflow.Org)
+	}
+	if workflow.RefName != "refs/pull/42/head" || workflow.RefType != models.RefTypePullRequest {
+		t.Errorf("Expected pull request refs/pull/42/head, got %s %s", workflow.RefType, workflow.RefName)
+	}
+	if workflow.PullRequest != 42 {
+		t.Errorf("Expected PullRequest 42, got %d", workflow.PullRequest)
+	}
+	if workflow.BaseRef != "master" {
+		t.Errorf("Expected BaseRef 'master', got '%s'", workflow.BaseRef)
+	}
+	if !workflow.Fork {
+		t.Error("Expected pull request from a fork")
+	}
+}
+
+func TestGitHub_PullRequestSameRepository(t *testing.T) {
+	doc := loadFixture(t, "webhook_github_pull_request.json", map[string]string{"X-Github-Event": "pull_request"})
+	pr := doc.Body["pull_request"].(map[string]interface{})
+	pr["head"].(map[string]interface{})["repo"] = pr["base"].(map[string]interface{})["repo"]
+
+	workflow := transformOne(t, doc)
+	if workflow == nil {
+		t.Fatal("Expected workflow to be created, got nil")
+	}
+	if workflow.Fork {
+		t.Error("Expected pull request not to come from a fork")
+	}
+	if workflow.URL != "git@github.com:baxterthehacker/public-repo.git" {
+		t.Errorf("Expected URL of the base repository, got '%s'", workflow.URL)
+	}
+}
+
+func TestGitHub_PullRequestActions(t *testing.T) {
+	tests := []struct {
+		name   string
+		action string
+		modify func(pr map[string]interface{})
+	}{
+		{"Opened", "opened", nil},
+		{"Reopened", "reopened", nil},
+		{"Closed", "closed", nil},
+		{"Labeled", "labeled", nil},
+		{"Deleted fork", "synchronize", func(pr map[string]interface{}) {
+			pr["head"].(map[string]interface{})["repo"] = nil
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := loadFixture(t, "webhook_github_pull_request.json", map[string]string{"X-Github-Event": "pull_request"})
+			doc.Body["action"] = tt.action
+			if tt.modify != nil {
+				tt.modify(doc.Body["pull_request"].(map[string]interface{}))
+			}
+
+			built := tt.action == "opened" || tt.action == "reopened"
+			if workflow := transformOne(t, doc); (workflow != nil) != built {
+				t.Errorf("Expected workflow built %v, got %+v", built, workflow)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package providers
+
+import (
+	"log"
+	"net/http"
+
+	"tsuribari/internal/models"
+)
+
+// GitLab adapts GitLab webhooks, which carry the secret token verbatim
+// in X-Gitlab-Token rather than a signature.
+type GitLab struct{}
+
+var gitlabSchemes = append([]SignatureScheme{
+	{Header: "X-Gitlab-Token", Parse: parseToken},
+}, hmacSchemes...)
+
+func (GitLab) Name() string { return "gitlab" }
+
+func (GitLab) Detect(header http.Header) bool {
+	return header.Get("X-Gitlab-Event") != "" || header.Get("X-Gitlab-Token") != ""
+}
+
+func (GitLab) Signature(r *http.Request) (Signature, bool) {
+	return findSignature(r.Header, gitlabSchemes)
+}
+
+func (GitLab) Event(header http.Header) string {
+	return header.Get("X-Gitlab-Event")
+}
+
+func (GitLab) Events() []string { return []string{"Push Hook", "Tag Push Hook"} }
+
+// Transform maps push and tag push events onto a workflow.
+func (p GitLab) Transform(doc *models.WebhookDoc) []*models.Workflow {
+	event := p.Event(docHeader(doc))
+	if event != "Push Hook" && event != "Tag Push Hook" {
+		log.Printf("DEBUG: ignoring gitlab event '%s'", event)
+		return nil
+	}
+
+	project, ok := doc.Body["project"].(map[string]interface{})
+	if !ok {
+		log.Printf("DEBUG: has no project")
+		return nil
+	}
+
+	sshURL, _ := project["git_ssh_url"].(string)
+	namespace, _ := project["namespace"].(string)
+
+	refName, _ := doc.Body["ref"].(string)
+	before, _ := doc.Body["before"].(string)
+
+	// checkout_sha is null when a branch or tag is deleted
+	checkoutSHA, _ := doc.Body["checkout_sha"].(string)
+	if after, _ := doc.Body["after"].(string); isZeroSHA(after) {
+		return single(deletion(doc, before, refName, sshURL, namespace))
+	}
+
+	log.Printf("DEBUG:  org: '%s', commit: '%s', url: '%s'", namespace, checkoutSHA, sshURL)
+
+	workflow := models.NewWorkflow(doc, checkoutSHA, refName, sshURL, namespace)
+	if workflow == nil {
+		return nil
+	}
+	workflow.Before = nonZeroSHA(before)
+	workflow.Message = commitMessage(doc.Body, checkoutSHA)
+
+	// GitLab lists at most 20 commits, so the paths of a longer push
+	// are not known
+	commits, _ := doc.Body["commits"].([]interface{})
+	if total, _ := doc.Body["total_commits_count"].(float64); int(total) <= len(commits) {
+		workflow.Changes = changedPaths(doc.Body)
+	}
+	return single(workflow)
+}
@@ -0,0 +1,135 @@
+package providers
+
+import (
+	"testing"
+
+	"tsuribari/internal/models"
+)
+
+func TestGitLab(t *testing.T) {
+	tests := []struct {
+		name        string
+		fixture     string
+		event       string
+		expectedRef string
+		refName     string
+		expectedURL string
+		expectedOrg string
+	}{
+		{
+			name:        "Push Hook",
+			fixture:     "webhook_gitlab_push.json",
+			event:       "Push Hook",
+			expectedRef: "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+			refName:     "refs/heads/master",
+			expectedURL: "git@example.com:mike/diaspora.git",
+			expectedOrg: "Mike",
+		},
+		{
+			name:        "Tag Push Hook",
+			fixture:     "webhook_gitlab_tag_push.json",
+			event:       "Tag Push Hook",
+			expectedRef: "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7",
+			refName:     "refs/tags/v1.0.0",
+			expectedURL: "git@example.com:jsmith/example.git",
+			expectedOrg: "Jsmith",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := loadFixture(t, tt.fixture, map[string]string{"X-Gitlab-Event": tt.event})
+
+			workflow := transformOne(t, doc)
+			if workflow == nil {
+				t.Fatal("Expected workflow to be created, got nil")
+			}
+
+			if workflow.Ref != tt.expectedRef {
+				t.Errorf("Expected Ref '%s', got '%s'", tt.expectedRef, workflow.Ref)
+			}
+			if workflow.RefName != tt.refName {
+				t.Errorf("Expected RefName '%s', got '%s'", tt.refName, workflow.RefName)
+			}
+			if workflow.URL != tt.expectedURL {
+				t.Errorf("Expected URL '%s', got '%s'", tt.expectedURL, workflow.URL)
+			}
+			if workflow.Org != tt.expectedOrg {
+				t.Errorf("Expected Org '%s', got '%s'", tt.expectedOrg, workflow.Org)
+			}
+			if len(workflow.Cache) != 64 {
+				t.Errorf("Expected cache length 64, got %d", len(workflow.Cache))
+			}
+		})
+	}
+}
+
+func TestGitLabDeleted(t *testing.T) {
+	doc := loadFixture(t, "webhook_gitlab_push.json", map[string]string{"X-Gitlab-Event": "Push Hook"})
+	doc.Body["after"] = "0000000000000000000000000000000000000000"
+	doc.Body["checkout_sha"] = nil
+	doc.Body["commits"] = []interface{}{}
+
+	workflow := transformOne(t, doc)
+	if workflow == nil {
+		t.Fatal("Expected workflow to be created, got nil")
+	}
+	if workflow.Action != models.ActionDelete || workflow.RefName != "refs/heads/master" {
+		t.Errorf("Expected refs/heads/master to be deleted, got %s %s", workflow.Action, workflow.RefName)
+	}
+	if workflow.Ref != "95790bf891e76fee5e1747ab589903a6a1f80f22" {
+		t.Errorf("Expected Ref of the deleted branch's last commit, got '%s'", workflow.Ref)
+	}
+}
+
+func TestGitLabIgnored(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		body  map[string]interface{}
+	}{
+		{
+			name:  "Other event",
+			event: "Merge Request Hook",
+			body: map[string]interface{}{
+				"checkout_sha": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+				"project": map[string]interface{}{
+					"git_ssh_url": "git@example.com:mike/diaspora.git",
+					"namespace":   "Mike",
+				},
+			},
+		},
+		{
+			name:  "Null checkout_sha",
+			event: "Push Hook",
+			body: map[string]interface{}{
+				"checkout_sha": nil,
+				"project": map[string]interface{}{
+					"git_ssh_url": "git@example.com:mike/diaspora.git",
+					"namespace":   "Mike",
+				},
+			},
+		},
+		{
+			name:  "Missing project",
+			event: "Push Hook",
+			body: map[string]interface{}{
+				"checkout_sha": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := &models.WebhookDoc{
+				ID:      "test-doc-id",
+				Headers: map[string]string{"X-Gitlab-Event": tt.event},
+				Body:    tt.body,
+			}
+
+			if workflow := transformOne(t, doc); workflow != nil {
+				t.Errorf("Expected nil workflow, got %+v", workflow)
+			}
+		})
+	}
+}
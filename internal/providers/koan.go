@@ -0,0 +1,62 @@
+package providers
+
+import (
+	"log"
+	"net/http"
+
+	"tsuribari/internal/models"
+)
+
+// Koan adapts the native models.KoanPush payload, posted by plain git
+// servers through `tsuribari notify`.
+type Koan struct{}
+
+func (Koan) Name() string { return "koan" }
+
+func (Koan) Detect(header http.Header) bool {
+	return header.Get("X-Koan-Event") != ""
+}
+
+func (Koan) Signature(r *http.Request) (Signature, bool) {
+	return findSignature(r.Header, hmacSchemes)
+}
+
+func (Koan) Event(header http.Header) string {
+	return header.Get("X-Koan-Event")
+}
+
+func (Koan) Events() []string { return []string{"push"} }
+
+// Transform maps a push onto a workflow.
+func (p Koan) Transform(doc *models.WebhookDoc) []*models.Workflow {
+	if event := p.Event(docHeader(doc)); event != "push" {
+		log.Printf("DEBUG: ignoring koan event '%s'", event)
+		return nil
+	}
+
+	sshURL, _ := doc.Body["url"].(string)
+	orgName, _ := doc.Body["org"].(string)
+	commitID, _ := doc.Body["after"].(string)
+	refName, _ := doc.Body["ref"].(string)
+	before, _ := doc.Body["before"].(string)
+
+	if isZeroSHA(commitID) {
+		return single(deletion(doc, before, refName, sshURL, orgName))
+	}
+
+	log.Printf("DEBUG:  org: '%s', commit: '%s', url: '%s'", orgName, commitID, sshURL)
+
+	workflow := models.NewWorkflow(doc, commitID, refName, sshURL, orgName)
+	if workflow == nil {
+		return nil
+	}
+	workflow.Before = nonZeroSHA(before)
+	workflow.Message, _ = doc.Body["message"].(string)
+	options, _ := doc.Body["push_options"].([]interface{})
+	for _, o := range options {
+		if option, ok := o.(string); ok {
+			workflow.PushOptions = append(workflow.PushOptions, option)
+		}
+	}
+	return single(workflow)
+}
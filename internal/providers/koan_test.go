@@ -0,0 +1,92 @@
+package providers
+
+import (
+	"testing"
+
+	"tsuribari/internal/models"
+)
+
+func TestKoan(t *testing.T) {
+	doc := loadFixture(t, "webhook_koan_push.json", map[string]string{"X-Koan-Event": "push"})
+
+	workflow := transformOne(t, doc)
+	if workflow == nil {
+		t.Fatal("Expected workflow to be created, got nil")
+	}
+
+	if workflow.Ref != "709d658dc5b6d6afcd46049c2f332ee3f515a67d" {
+		t.Errorf("Expected Ref '709d658dc5b6d6afcd46049c2f332ee3f515a67d', got '%s'", workflow.Ref)
+	}
+	if workflow.RefName != "refs/heads/main" {
+		t.Errorf("Expected RefName 'refs/heads/main', got '%s'", workflow.RefName)
+	}
+	if workflow.URL != "git@git.example:skunkwerks/tsuribari.git" {
+		t.Errorf("Expected URL 'git@git.example:skunkwerks/tsuribari.git', got '%s'", workflow.URL)
+	}
+	if workflow.Org != "skunkwerks" {
+		t.Errorf("Expected Org 'skunkwerks', got '%s'", workflow.Org)
+	}
+}
+
+func TestKoanSkipDirectives(t *testing.T) {
+	doc := loadFixture(t, "webhook_koan_push.json", map[string]string{"X-Koan-Event": "push"})
+	doc.Body["message"] = "Fix typo [skip ci]"
+	doc.Body["push_options"] = []interface{}{"ci.skip", "merge_request.create"}
+
+	workflow := transformOne(t, doc)
+	if workflow == nil {
+		t.Fatal("Expected workflow to be created, got nil")
+	}
+	if workflow.Message != "Fix typo [skip ci]" {
+		t.Errorf("Expected Message 'Fix typo [skip ci]', got '%s'", workflow.Message)
+	}
+	if len(workflow.PushOptions) != 2 || workflow.PushOptions[0] != "ci.skip" {
+		t.Errorf("Expected PushOptions [ci.skip merge_request.create], got %v", workflow.PushOptions)
+	}
+}
+
+func TestKoanDeleted(t *testing.T) {
+	doc := loadFixture(t, "webhook_koan_push.json", map[string]string{"X-Koan-Event": "push"})
+	doc.Body["after"] = "0000000000000000000000000000000000000000"
+
+	workflow := transformOne(t, doc)
+	if workflow == nil {
+		t.Fatal("Expected workflow to be created, got nil")
+	}
+	if workflow.Action != models.ActionDelete || workflow.RefName != "refs/heads/main" {
+		t.Errorf("Expected refs/heads/main to be deleted, got %s %s", workflow.Action, workflow.RefName)
+	}
+	if workflow.Ref != "1e65c05c1d5171631d92438a13901ca7dae9618c" {
+		t.Errorf("Expected Ref of the deleted branch's last commit, got '%s'", workflow.Ref)
+	}
+}
+
+func TestKoanIgnored(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		after string
+	}{
+		{"Other event", "tag", "709d658dc5b6d6afcd46049c2f332ee3f515a67d"},
+		{"Deleted ref without old commit", "push", "0000000000000000000000000000000000000000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := &models.WebhookDoc{
+				ID:      "test-doc-id",
+				Headers: map[string]string{"X-Koan-Event": tt.event},
+				Body: map[string]interface{}{
+					"ref":   "refs/heads/main",
+					"after": tt.after,
+					"url":   "git@git.example:skunkwerks/tsuribari.git",
+					"org":   "skunkwerks",
+				},
+			}
+
+			if workflow := transformOne(t, doc); workflow != nil {
+				t.Errorf("Expected nil workflow, got %+v", workflow)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package providers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"tsuribari/internal/config"
+	"tsuribari/internal/mapping"
+	"tsuribari/internal/models"
+)
+
+// Mapping transforms webhooks from senders without a provider of their
+// own, such as internal tools or registry hooks, using the mappings
+// declared for each organisation and pipeline. It is never detected, so
+// it must be selected with `providers: ["mapping"]`. Senders may sign
+// with any generic HMAC header or pass a token as ?token=.
+type Mapping struct {
+	// mappings is keyed by organisation, or organisation/pipeline.
+	mappings map[string]*mapping.Mapping
+}
+
+// NewMapping compiles the mappings of every organisation and pipeline.
+func NewMapping(orgs map[string]config.Organisation) (*Mapping, error) {
+	m := &Mapping{mappings: make(map[string]*mapping.Mapping)}
+
+	add := func(key string, providers []string, declared *config.Mapping) error {
+		if declared == nil {
+			for _, name := range providers {
+				if name == "mapping" {
+					return fmt.Errorf("%s: provider mapping without a mapping", key)
+				}
+			}
+			return nil
+		}
+		compiled, err := mapping.Compile(*declared)
+		if err != nil {
+			return fmt.Errorf("%s: mapping %w", key, err)
+		}
+		m.mappings[key] = compiled
+		return nil
+	}
+
+	for name, org := range orgs {
+		if err := add(name, org.Providers, org.Mapping); err != nil {
+			return nil, err
+		}
+		for pipeline := range org.Pipelines {
+			key := name + "/" + pipeline
+			if err := add(key, org.ProvidersFor(pipeline), org.MappingFor(pipeline)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+func (*Mapping) Name() string { return "mapping" }
+
+func (*Mapping) Detect(header http.Header) bool { return false }
+
+func (*Mapping) Signature(r *http.Request) (Signature, bool) {
+	if signature, found := findSignature(r.Header, hmacSchemes); found {
+		return signature, true
+	}
+	return queryToken(r)
+}
+
+func (*Mapping) Event(header http.Header) string { return "" }
+
+func (*Mapping) Events() []string { return nil }
+
+// Transform applies the mapping of the document's pipeline, or of its
+// organisation. Evaluation errors are recorded on the document.
+func (m *Mapping) Transform(doc *models.WebhookDoc) []*models.Workflow {
+	key := doc.Organisation
+	if doc.Pipeline != "" {
+		key += "/" + doc.Pipeline
+	}
+
+	compiled, ok := m.mappings[key]
+	if !ok {
+		doc.TransformError = "no mapping for " + key
+		return nil
+	}
+
+	workflow, err := compiled.Apply(doc)
+	if err != nil {
+		log.Printf("INFO: mapping %s: %v", key, err)
+		doc.TransformError = err.Error()
+		return nil
+	}
+	if workflow == nil {
+		log.Printf("DEBUG: mapping %s: match conditions do not hold", key)
+	}
+	return single(workflow)
+}
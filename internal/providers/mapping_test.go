@@ -0,0 +1,201 @@
+package providers
+
+import (
+	"strings"
+	"testing"
+
+	"tsuribari/internal/config"
+	"tsuribari/internal/models"
+)
+
+func mappingOrgs() map[string]config.Organisation {
+	return map[string]config.Organisation{
+		"tools": {
+			Providers: []string{"mapping"},
+			Mapping: &config.Mapping{
+				Ref:   "$.build.commit",
+				URL:   "git@git.example:{{ $.build.repo }}.git",
+				Org:   "tools",
+				Match: []config.Match{{Value: "$header.X-Tool-Event", Equals: "build"}},
+			},
+			Pipelines: map[string]config.Pipeline{
+				"images": {
+					Mapping: &config.Mapping{
+						Ref: "$.events[0].target.digest",
+						URL: "$.events[0].target.repository",
+						Org: "images",
+					},
+				},
+				"docs": {},
+			},
+		},
+	}
+}
+
+func mappingDoc(pipeline string) *models.WebhookDoc {
+	return &models.WebhookDoc{
+		ID:           "test-doc-id",
+		Organisation: "tools",
+		Pipeline:     pipeline,
+		Headers:      map[string]string{"X-Tool-Event": "build"},
+		Body: map[string]interface{}{
+			"build": map[string]interface{}{
+				"commit": "abc123def456789",
+				"repo":   "tools/widget",
+			},
+			"events": []interface{}{
+				map[string]interface{}{
+					"target": map[string]interface{}{
+						"digest":     "sha256:0f1e2d",
+						"repository": "registry.example/widget",
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestMapping_Transform(t *testing.T) {
+	m, err := NewMapping(mappingOrgs())
+	if err != nil {
+		t.Fatalf("Expected mappings to compile, got %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		pipeline string
+		ref      string
+		url      string
+		org      string
+	}{
+		{"Organisation", "", "abc123def456789", "git@git.example:tools/widget.git", "tools"},
+		{"Inherited by pipeline", "docs", "abc123def456789", "git@git.example:tools/widget.git", "tools"},
+		{"Pipeline override", "images", "sha256:0f1e2d", "registry.example/widget", "images"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := mappingDoc(tt.pipeline)
+
+			workflows := m.Transform(doc)
+			if len(workflows) != 1 {
+				t.Fatalf("Expected 1 workflow, got %d (%s)", len(workflows), doc.TransformError)
+			}
+
+			workflow := workflows[0]
+			if workflow.Ref != tt.ref {
+				t.Errorf("Expected Ref '%s', got '%s'", tt.ref, workflow.Ref)
+			}
+			if workflow.URL != tt.url {
+				t.Errorf("Expected URL '%s', got '%s'", tt.url, workflow.URL)
+			}
+			if workflow.Org != tt.org {
+				t.Errorf("Expected Org '%s', got '%s'", tt.org, workflow.Org)
+			}
+			if workflow.Pipeline != tt.pipeline {
+				t.Errorf("Expected Pipeline '%s', got '%s'", tt.pipeline, workflow.Pipeline)
+			}
+		})
+	}
+}
+
+func TestMapping_TransformNoMatch(t *testing.T) {
+	m, err := NewMapping(mappingOrgs())
+	if err != nil {
+		t.Fatalf("Expected mappings to compile, got %v", err)
+	}
+
+	doc := mappingDoc("")
+	doc.Headers["X-Tool-Event"] = "lint"
+
+	if workflows := m.Transform(doc); len(workflows) != 0 {
+		t.Errorf("Expected no workflows, got %d", len(workflows))
+	}
+	if doc.TransformError != "" {
+		t.Errorf("Expected no transform error, got '%s'", doc.TransformError)
+	}
+}
+
+func TestMapping_TransformErrors(t *testing.T) {
+	m, err := NewMapping(mappingOrgs())
+	if err != nil {
+		t.Fatalf("Expected mappings to compile, got %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		doc      func() *models.WebhookDoc
+		expected string
+	}{
+		{
+			name: "Missing field",
+			doc: func() *models.WebhookDoc {
+				doc := mappingDoc("")
+				delete(doc.Body["build"].(map[string]interface{}), "commit")
+				return doc
+			},
+			expected: `ref "$.build.commit": $.build.commit not found`,
+		},
+		{
+			name: "Unknown organisation",
+			doc: func() *models.WebhookDoc {
+				doc := mappingDoc("")
+				doc.Organisation = "other"
+				return doc
+			},
+			expected: "no mapping for other",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := tt.doc()
+
+			if workflows := m.Transform(doc); len(workflows) != 0 {
+				t.Errorf("Expected no workflows, got %d", len(workflows))
+			}
+			if doc.TransformError != tt.expected {
+				t.Errorf("Expected transform error '%s', got '%s'", tt.expected, doc.TransformError)
+			}
+		})
+	}
+}
+
+func TestNewMapping_Invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		orgs     map[string]config.Organisation
+		expected string
+	}{
+		{
+			name: "Provider without mapping",
+			orgs: map[string]config.Organisation{
+				"tools": {Providers: []string{"mapping"}},
+			},
+			expected: "tools: provider mapping without a mapping",
+		},
+		{
+			name: "Invalid expression",
+			orgs: map[string]config.Organisation{
+				"tools": {
+					Pipelines: map[string]config.Pipeline{
+						"images": {Mapping: &config.Mapping{Ref: "$.a..b", URL: "$.url", Org: "images"}},
+					},
+				},
+			},
+			expected: "tools/images: mapping ref",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewMapping(tt.orgs)
+			if err == nil {
+				t.Fatal("Expected error, got nil")
+			}
+			if !strings.HasPrefix(err.Error(), tt.expected) {
+				t.Errorf("Expected error starting '%s', got '%s'", tt.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package providers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"tsuribari/internal/config"
+	"tsuribari/internal/models"
+)
+
+// Provider adapts the webhooks of one sender, such as GitHub or GitLab.
+type Provider interface {
+	// Name identifies the provider in configuration and on stored
+	// webhook documents.
+	Name() string
+
+	// Detect reports whether the request headers come from this
+	// provider.
+	Detect(header http.Header) bool
+
+	// Signature returns the strongest signature the request carries in
+	// a form this provider sends, for Verify to check.
+	Signature(r *http.Request) (Signature, bool)
+
+	// Event returns the provider's name for the kind of event, or ""
+	// if the request does not say.
+	Event(header http.Header) string
+
+	// Events lists the events Transform can build workflows from.
+	Events() []string
+
+	// Transform returns one workflow per ref the webhook updates, or
+	// nil if it does not describe a build. Problems the sender should
+	// know about are recorded in doc.TransformError.
+	Transform(doc *models.WebhookDoc) []*models.Workflow
+}
+
+// Registry holds the known providers in detection order, and a fallback
+// for requests no provider recognises.
+type Registry struct {
+	providers []Provider
+	byName    map[string]Provider
+	fallback  Provider
+}
+
+// NewRegistry returns a registry that detects the providers in the given
+// order, and otherwise assumes fallback.
+func NewRegistry(fallback Provider, providers ...Provider) *Registry {
+	r := &Registry{
+		byName:   map[string]Provider{fallback.Name(): fallback},
+		fallback: fallback,
+	}
+	for _, p := range providers {
+		r.Register(p)
+	}
+	return r
+}
+
+// Default returns a registry of the built-in providers. Requests no
+// other provider recognises are assumed to come from GitHub.
+func Default() *Registry {
+	return NewRegistry(GitHub{},
+		Koan{},
+		GitLab{},
+		Forgejo{},
+		BitbucketCloud{},
+		BitbucketDataCenter{},
+	)
+}
+
+// Register adds a provider, detected after those already registered. It
+// panics if the name is taken.
+func (r *Registry) Register(p Provider) {
+	if _, exists := r.byName[p.Name()]; exists {
+		panic("providers: duplicate provider " + p.Name())
+	}
+	r.providers = append(r.providers, p)
+	r.byName[p.Name()] = p
+}
+
+// Get returns the provider with the given name.
+func (r *Registry) Get(name string) (Provider, bool) {
+	p, ok := r.byName[name]
+	return p, ok
+}
+
+// Detect returns the first provider recognising the headers, or the
+// fallback.
+func (r *Registry) Detect(header http.Header) Provider {
+	for _, p := range r.providers {
+		if p.Detect(header) {
+			return p
+		}
+	}
+	return r.fallback
+}
+
+// Resolve picks the provider for a request, given the names of the
+// accepted providers. A single accepted provider is always used;
+// otherwise the detected provider is returned, and reported whether it
+// is accepted. An empty list accepts every provider.
+func (r *Registry) Resolve(header http.Header, accepted []string) (Provider, bool) {
+	if len(accepted) == 1 {
+		return r.Get(accepted[0])
+	}
+
+	p := r.Detect(header)
+	if len(accepted) == 0 {
+		return p, true
+	}
+	for _, name := range accepted {
+		if name == p.Name() {
+			return p, true
+		}
+	}
+	return p, false
+}
+
+// Validate checks that every provider named by an organisation or
+// pipeline is registered.
+func (r *Registry) Validate(orgs map[string]config.Organisation) error {
+	for name, org := range orgs {
+		if err := r.validateNames(org.Providers); err != nil {
+			return fmt.Errorf("organisation %s: %w", name, err)
+		}
+		for pipeline, p := range org.Pipelines {
+			if err := r.validateNames(p.Providers); err != nil {
+				return fmt.Errorf("organisation %s pipeline %s: %w", name, pipeline, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Registry) validateNames(names []string) error {
+	for _, name := range names {
+		if _, ok := r.byName[name]; !ok {
+			return fmt.Errorf("unknown provider %q", name)
+		}
+	}
+	return nil
+}
+
+// IsPing reports whether the event only checks that the webhook is
+// reachable, as GitHub and Bitbucket Data Center send when a webhook is
+// created or tested.
+func IsPing(event string) bool {
+	return event == "ping" || event == "diagnostics:ping"
+}
+
+// isZeroSHA reports whether a commit ID is all zeros, as senders give
+// the old commit of a new ref and the new commit of a deleted one.
+func isZeroSHA(id string) bool {
+	return id != "" && strings.Trim(id, "0") == ""
+}
+
+// nonZeroSHA returns the commit ID, or "" if it is all zeros.
+func nonZeroSHA(id string) string {
+	if isZeroSHA(id) {
+		return ""
+	}
+	return id
+}
+
+// deletion builds the workflow for a deleted branch or tag, using the
+// commit it pointed to as ref.
+func deletion(doc *models.WebhookDoc, before, refName, url, org string) *models.Workflow {
+	log.Printf("DEBUG:  org: '%s', deleted: '%s', url: '%s'", org, refName, url)
+
+	workflow := models.NewWorkflow(doc, nonZeroSHA(before), refName, url, org)
+	if workflow == nil {
+		return nil
+	}
+	workflow.Action = models.ActionDelete
+	workflow.Before = workflow.Ref
+	return workflow
+}
+
+// changedPaths collects the paths added, modified or removed by the
+// commits of a GitHub-style push, in order and without duplicates. It
+// returns nil when the payload lists no commits, as for a new tag, so
+// that nothing is known to have changed rather than nothing changed.
+func changedPaths(body map[string]interface{}) []string {
+	commits, _ := body["commits"].([]interface{})
+	if len(commits) == 0 {
+		return nil
+	}
+
+	paths := []string{}
+	seen := make(map[string]bool)
+	for _, c := range commits {
+		commit, _ := c.(map[string]interface{})
+		for _, key := range []string{"added", "modified", "removed"} {
+			files, _ := commit[key].([]interface{})
+			for _, f := range files {
+				if path, ok := f.(string); ok && !seen[path] {
+					seen[path] = true
+					paths = append(paths, path)
+				}
+			}
+		}
+	}
+	return paths
+}
+
+// commitMessage returns the message of the commit built by a
+// GitHub-style push: that of head_commit or, failing it, of the listed
+// commit with the given ID.
+func commitMessage(body map[string]interface{}, id string) string {
+	if head, ok := body["head_commit"].(map[string]interface{}); ok {
+		if message, ok := head["message"].(string); ok {
+			return message
+		}
+	}
+
+	commits, _ := body["commits"].([]interface{})
+	for _, c := range commits {
+		commit, _ := c.(map[string]interface{})
+		if commitID, _ := commit["id"].(string); commitID == id {
+			message, _ := commit["message"].(string)
+			return message
+		}
+	}
+	return ""
+}
+
+// docHeader rebuilds the request headers stored on a webhook document.
+func docHeader(doc *models.WebhookDoc) http.Header {
+	header := make(http.Header, len(doc.Headers))
+	for name, value := range doc.Headers {
+		header.Set(name, value)
+	}
+	return header
+}
@@ -0,0 +1,289 @@
+package providers
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"tsuribari/internal/config"
+	"tsuribari/internal/models"
+)
+
+func loadFixture(t *testing.T, name string, headers map[string]string) *models.WebhookDoc {
+	t.Helper()
+
+	body, err := os.ReadFile("../../testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := models.NewWebhookDoc("", "", headers, body)
+	if err != nil {
+		t.Fatalf("Expected fixture %s to parse, got %v", name, err)
+	}
+	return doc
+}
+
+// transform runs the provider detected from the document headers.
+func transform(doc *models.WebhookDoc) []*models.Workflow {
+	return Default().Detect(docHeader(doc)).Transform(doc)
+}
+
+// transformOne is transform for webhooks describing at most one ref.
+func transformOne(t *testing.T, doc *models.WebhookDoc) *models.Workflow {
+	t.Helper()
+
+	workflows := transform(doc)
+	switch len(workflows) {
+	case 0:
+		return nil
+	case 1:
+		return workflows[0]
+	}
+	t.Fatalf("Expected at most one workflow, got %d", len(workflows))
+	return nil
+}
+
+func TestRegistry_Detect(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected string
+	}{
+		{"GitHub", map[string]string{"X-GitHub-Event": "push"}, "github"},
+		{"No headers", map[string]string{}, "github"},
+		{"GitLab", map[string]string{"X-Gitlab-Event": "Push Hook"}, "gitlab"},
+		{"GitLab token", map[string]string{"X-Gitlab-Token": "secret"}, "gitlab"},
+		{"Forgejo", map[string]string{"X-Forgejo-Event": "push", "X-GitHub-Event": "push"}, "forgejo"},
+		{"Gitea", map[string]string{"X-Gitea-Event": "push", "X-GitHub-Event": "push"}, "forgejo"},
+		{"Bitbucket Cloud", map[string]string{"X-Event-Key": "repo:push", "X-Hook-UUID": "b4a6c1d2"}, "bitbucket-cloud"},
+		{"Bitbucket Data Center", map[string]string{"X-Event-Key": "repo:refs_changed"}, "bitbucket-datacenter"},
+		{"Koan", map[string]string{"X-Koan-Event": "push"}, "koan"},
+	}
+
+	registry := Default()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(http.Header)
+			for name, value := range tt.headers {
+				header.Set(name, value)
+			}
+
+			if provider := registry.Detect(header); provider.Name() != tt.expected {
+				t.Errorf("Expected provider %s, got %s", tt.expected, provider.Name())
+			}
+		})
+	}
+}
+
+func TestRegistry_Resolve(t *testing.T) {
+	registry := Default()
+	header := http.Header{"X-Gitlab-Event": {"Push Hook"}}
+
+	tests := []struct {
+		name             string
+		providers        []string
+		expectedProvider string
+		expectedOK       bool
+	}{
+		{"All accepted", nil, "gitlab", true},
+		{"Detected and accepted", []string{"github", "gitlab"}, "gitlab", true},
+		{"Detected but refused", []string{"github", "forgejo"}, "gitlab", false},
+		{"Single provider", []string{"koan"}, "koan", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, ok := registry.Resolve(header, tt.providers)
+			if ok != tt.expectedOK {
+				t.Errorf("Expected ok %v, got %v", tt.expectedOK, ok)
+			}
+			if provider.Name() != tt.expectedProvider {
+				t.Errorf("Expected provider %s, got %s", tt.expectedProvider, provider.Name())
+			}
+		})
+	}
+}
+
+// custom is a minimal provider registered from outside the defaults.
+type custom struct{ GitHub }
+
+func (custom) Name() string { return "custom" }
+
+func (custom) Detect(header http.Header) bool {
+	return header.Get("X-Custom-Event") != ""
+}
+
+func TestRegistry_Register(t *testing.T) {
+	registry := Default()
+	registry.Register(custom{})
+
+	if provider := registry.Detect(http.Header{"X-Custom-Event": {"push"}}); provider.Name() != "custom" {
+		t.Errorf("Expected provider custom, got %s", provider.Name())
+	}
+	if _, ok := registry.Get("custom"); !ok {
+		t.Error("Expected custom provider to be registered")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected duplicate registration to panic")
+		}
+	}()
+	registry.Register(custom{})
+}
+
+func TestRegistry_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		providers []string
+		expectErr bool
+	}{
+		{"Empty", nil, false},
+		{"Known", []string{"github", "bitbucket-cloud", "bitbucket-datacenter"}, false},
+		{"Unknown", []string{"github", "sourcehut"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orgs := map[string]config.Organisation{
+				"demo": {Providers: tt.providers},
+			}
+			if err := Default().Validate(orgs); (err != nil) != tt.expectErr {
+				t.Errorf("Expected error %v, got %v", tt.expectErr, err)
+			}
+
+			orgs = map[string]config.Organisation{
+				"demo": {Pipelines: map[string]config.Pipeline{"build": {Providers: tt.providers}}},
+			}
+
+			err := Default().Validate(orgs)
+			if tt.expectErr && err == nil {
+				t.Error("Expected error, got nil")
+			}
+			if !tt.expectErr && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestChangedPaths(t *testing.T) {
+	tests := []struct {
+		name     string
+		fixture  string
+		headers  map[string]string
+		expected []string
+	}{
+		{
+			name:     "GitHub",
+			fixture:  "webhook_github.json",
+			headers:  map[string]string{"X-Github-Event": "push"},
+			expected: []string{"README.md"},
+		},
+		{
+			name:     "GitLab, duplicates removed",
+			fixture:  "webhook_gitlab_push.json",
+			headers:  map[string]string{"X-Gitlab-Event": "Push Hook"},
+			expected: []string{"CHANGELOG", "app/controller/application.rb"},
+		},
+		{
+			name:     "GitLab tag without commits",
+			fixture:  "webhook_gitlab_tag_push.json",
+			headers:  map[string]string{"X-Gitlab-Event": "Tag Push Hook"},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := loadFixture(t, tt.fixture, tt.headers)
+
+			workflow := transformOne(t, doc)
+			if workflow == nil {
+				t.Fatal("Expected workflow to be created, got nil")
+			}
+			if tt.expected == nil && workflow.Changes != nil {
+				t.Errorf("Expected unknown changes, got %v", workflow.Changes)
+			}
+			if strings.Join(workflow.Changes, " ") != strings.Join(tt.expected, " ") {
+				t.Errorf("Expected changes %v, got %v", tt.expected, workflow.Changes)
+			}
+		})
+	}
+}
+
+func TestChangedPaths_TruncatedGitLabPush(t *testing.T) {
+	doc := loadFixture(t, "webhook_gitlab_push.json", map[string]string{"X-Gitlab-Event": "Push Hook"})
+	doc.Body["total_commits_count"] = float64(21)
+
+	workflow := transformOne(t, doc)
+	if workflow == nil {
+		t.Fatal("Expected workflow to be created, got nil")
+	}
+	if workflow.Changes != nil {
+		t.Errorf("Expected unknown changes for a truncated push, got %v", workflow.Changes)
+	}
+}
+
+func TestCommitMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		fixture  string
+		headers  map[string]string
+		expected string
+	}{
+		{
+			name:     "GitHub head commit",
+			fixture:  "webhook_github.json",
+			headers:  map[string]string{"X-Github-Event": "push"},
+			expected: "Update README.md",
+		},
+		{
+			name:     "GitLab checkout commit",
+			fixture:  "webhook_gitlab_push.json",
+			headers:  map[string]string{"X-Gitlab-Event": "Push Hook"},
+			expected: "fixed readme",
+		},
+		{
+			name:     "Forgejo head commit",
+			fixture:  "webhook_forgejo_push.json",
+			headers:  map[string]string{"X-Forgejo-Event": "push"},
+			expected: "Update README\n",
+		},
+		{
+			name:     "GitLab tag without commits",
+			fixture:  "webhook_gitlab_tag_push.json",
+			headers:  map[string]string{"X-Gitlab-Event": "Tag Push Hook"},
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := loadFixture(t, tt.fixture, tt.headers)
+
+			workflow := transformOne(t, doc)
+			if workflow == nil {
+				t.Fatal("Expected workflow to be created, got nil")
+			}
+			if workflow.Message != tt.expected {
+				t.Errorf("Expected message %q, got %q", tt.expected, workflow.Message)
+			}
+		})
+	}
+}
+
+func TestIsPing(t *testing.T) {
+	for event, expected := range map[string]bool{
+		"ping":             true,
+		"diagnostics:ping": true,
+		"push":             false,
+		"":                 false,
+	} {
+		if IsPing(event) != expected {
+			t.Errorf("Expected IsPing(%q) to be %v", event, expected)
+		}
+	}
+}
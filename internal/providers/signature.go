@@ -0,0 +1,213 @@
+package providers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Algorithm identifies the hash function behind an HMAC signature.
+// Stronger algorithms compare greater than weaker ones. Token is a shared
+// secret sent verbatim, and is weaker than any HMAC.
+type Algorithm int
+
+const (
+	Token Algorithm = iota + 1
+	SHA1
+	SHA256
+	SHA512
+)
+
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch strings.ToLower(name) {
+	case "token":
+		return Token, nil
+	case "sha1":
+		return SHA1, nil
+	case "sha256":
+		return SHA256, nil
+	case "sha512":
+		return SHA512, nil
+	}
+	return 0, fmt.Errorf("unknown hmac algorithm %q", name)
+}
+
+func (a Algorithm) String() string {
+	switch a {
+	case Token:
+		return "token"
+	case SHA1:
+		return "sha1"
+	case SHA256:
+		return "sha256"
+	case SHA512:
+		return "sha512"
+	}
+	return "unknown"
+}
+
+func (a Algorithm) hash() func() hash.Hash {
+	switch a {
+	case SHA1:
+		return sha1.New
+	case SHA256:
+		return sha256.New
+	case SHA512:
+		return sha512.New
+	}
+	return nil
+}
+
+// Signature is an HMAC digest as sent by the webhook sender. When
+// Timestamp is set, the digest covers "<unix timestamp>.<body>".
+type Signature struct {
+	Header    string
+	Algorithm Algorithm
+	Digest    string
+	Timestamp time.Time
+}
+
+// SignatureScheme describes how a sender transmits its signature in a
+// particular request header.
+type SignatureScheme struct {
+	Header string
+	Parse  func(value string) (Signature, bool)
+}
+
+// hmacSchemes are accepted from every provider, so that a relay or a
+// custom sender can always sign with them. When a request carries
+// several signatures, the strongest algorithm wins.
+var hmacSchemes = []SignatureScheme{
+	{Header: "X-Hub-Signature-256", Parse: parsePrefixed},
+	{Header: "X-Koan-Signature", Parse: parseKoan},
+	{Header: "X-Hub-Signature", Parse: parsePrefixed},
+}
+
+// findSignature returns the strongest signature present in the headers
+// under any of the schemes.
+func findSignature(headers http.Header, schemes []SignatureScheme) (Signature, bool) {
+	var best Signature
+	found := false
+	for _, scheme := range schemes {
+		value := headers.Get(scheme.Header)
+		if value == "" {
+			continue
+		}
+		signature, ok := scheme.Parse(value)
+		if !ok {
+			continue
+		}
+		if !found || signature.Algorithm > best.Algorithm {
+			signature.Header = scheme.Header
+			best = signature
+			found = true
+		}
+	}
+	return best, found
+}
+
+// queryToken returns the shared secret passed as ?token=, for senders
+// that can neither sign nor set headers.
+func queryToken(r *http.Request) (Signature, bool) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return Signature{}, false
+	}
+	return Signature{Algorithm: Token, Digest: token}, true
+}
+
+// parsePrefixed parses the GitHub style "<algorithm>=<hex digest>" form.
+func parsePrefixed(value string) (Signature, bool) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return Signature{}, false
+	}
+
+	algorithm, err := ParseAlgorithm(parts[0])
+	if err != nil {
+		return Signature{}, false
+	}
+
+	return Signature{Algorithm: algorithm, Digest: parts[1]}, true
+}
+
+// parseHexSHA256 parses the Gitea and Forgejo form, a bare hex digest
+// which is always HMAC-SHA256.
+func parseHexSHA256(value string) (Signature, bool) {
+	return Signature{Algorithm: SHA256, Digest: value}, true
+}
+
+// parseKoan accepts both the prefixed form and the timestamped form.
+func parseKoan(value string) (Signature, bool) {
+	if strings.HasPrefix(value, "t=") {
+		return parseTimestamped(value)
+	}
+	return parsePrefixed(value)
+}
+
+// parseTimestamped parses the Stripe style "t=<unix>,v1=<hex sha256>"
+// form, in which the signed timestamp guards against replays.
+func parseTimestamped(value string) (Signature, bool) {
+	signature := Signature{Algorithm: SHA256}
+	for _, field := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return Signature{}, false
+		}
+		switch key {
+		case "t":
+			seconds, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return Signature{}, false
+			}
+			signature.Timestamp = time.Unix(seconds, 0).UTC()
+		case "v1":
+			if signature.Digest == "" {
+				signature.Digest = val
+			}
+		}
+	}
+
+	if signature.Timestamp.IsZero() || signature.Digest == "" {
+		return Signature{}, false
+	}
+	return signature, true
+}
+
+// parseToken accepts a shared secret sent as is, as GitLab does.
+func parseToken(value string) (Signature, bool) {
+	return Signature{Algorithm: Token, Digest: value}, true
+}
+
+// Verify reports whether the signature was made with secret over body.
+func Verify(signature Signature, secret string, body []byte) bool {
+	if signature.Algorithm == Token {
+		// Compare digests so that the secret length does not leak
+		got := sha256.Sum256([]byte(signature.Digest))
+		want := sha256.Sum256([]byte(secret))
+		return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+	}
+
+	newHash := signature.Algorithm.hash()
+	if newHash == nil || signature.Digest == "" {
+		return false
+	}
+
+	expectedMAC := hmac.New(newHash, []byte(secret))
+	if !signature.Timestamp.IsZero() {
+		expectedMAC.Write([]byte(strconv.FormatInt(signature.Timestamp.Unix(), 10) + "."))
+	}
+	expectedMAC.Write(body)
+	expectedSignature := hex.EncodeToString(expectedMAC.Sum(nil))
+
+	return subtle.ConstantTimeCompare([]byte(strings.ToLower(signature.Digest)), []byte(expectedSignature)) == 1
+}
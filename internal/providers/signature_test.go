@@ -0,0 +1,86 @@
+package providers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	secret := "testsecret123"
+	body := []byte(`{"test": "data"}`)
+
+	// Generate valid signature
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write(body)
+	validSignature := "sha1=" + hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name      string
+		signature string
+		secret    string
+		body      []byte
+		expected  bool
+	}{
+		{
+			name:      "Valid signature",
+			signature: validSignature,
+			secret:    secret,
+			body:      body,
+			expected:  true,
+		},
+		{
+			name:      "Invalid signature",
+			signature: "sha1=invalidsignature",
+			secret:    secret,
+			body:      body,
+			expected:  false,
+		},
+		{
+			name:      "Wrong secret",
+			signature: validSignature,
+			secret:    "wrongsecret",
+			body:      body,
+			expected:  false,
+		},
+		{
+			name:      "Empty signature",
+			signature: "",
+			secret:    secret,
+			body:      body,
+			expected:  false,
+		},
+		{
+			name:      "Wrong algorithm",
+			signature: "md5=somehash",
+			secret:    secret,
+			body:      body,
+			expected:  false,
+		},
+		{
+			name:      "Malformed signature",
+			signature: "invalidsignature",
+			secret:    secret,
+			body:      body,
+			expected:  false,
+		},
+		{
+			name:      "Different body",
+			signature: validSignature,
+			secret:    secret,
+			body:      []byte(`{"different": "data"}`),
+			expected:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signature, ok := parsePrefixed(tt.signature)
+			result := ok && Verify(signature, tt.secret, tt.body)
+			if result != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, result)
+			}
+		})
+	}
+}
@@ -2,33 +2,245 @@ package queue
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
 
 	"github.com/streadway/amqp"
 
+	"tsuribari/internal/config"
 	"tsuribari/internal/models"
 )
 
+// Connection states reported by State.
+const (
+	StateConnected    = "connected"
+	StateReconnecting = "reconnecting"
+	StateClosed       = "closed"
+)
+
+// Delays between reconnection attempts, doubled after each failure and
+// jittered so that restarted brokers are not hit by every client at once.
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+const defaultConfirmTimeout = 5 * time.Second
+
+// appID identifies tsuribari as the publisher of workflow messages.
+const appID = "tsuribari"
+
+// Errors returned by PublishWorkflow when the broker does not take a
+// message. Nothing is buffered: the outbox retries the workflow later.
+var (
+	// ErrDisconnected is returned while the connection to the broker
+	// is being re-established.
+	ErrDisconnected = errors.New("rabbitmq: disconnected")
+
+	// ErrUnroutable is returned when no queue is bound for the
+	// message's routing key.
+	ErrUnroutable = errors.New("rabbitmq: unroutable")
+
+	// ErrNacked is returned when the broker could not take the message.
+	ErrNacked = errors.New("rabbitmq: nacked")
+
+	// ErrConfirmTimeout is returned when the broker does not confirm the
+	// message in time. The connection is then re-established.
+	ErrConfirmTimeout = errors.New("rabbitmq: confirmation timed out")
+)
+
+// RabbitMQ publishes workflows to a topic exchange, waiting for the broker
+// to confirm each one. It watches its connection and channel, and when
+// either closes, reconnects and re-declares the exchange, queue and
+// binding.
 type RabbitMQ struct {
-	conn     *amqp.Connection
-	channel  *amqp.Channel
-	exchange string
-	queue    string
+	url            string
+	exchange       string
+	queue          string
+	routingKey     string
+	queueKeys      []string
+	bindings       []config.Binding
+	maxPriority    uint8
+	confirmTimeout time.Duration
+
+	// dial opens a session, and is replaced in tests
+	dial     func() (*session, error)
+	minDelay time.Duration
+	maxDelay time.Duration
+
+	mu      sync.RWMutex
+	session *session
+	state   string
+
+	// publishing keeps a single message in flight, so that the next
+	// confirmation is always that of the message just sent
+	publishing sync.Mutex
+
+	done chan struct{}
+}
+
+// session is a channel in confirm mode, with its confirmations and
+// returned messages. closed receives the error closing either the
+// channel or its connection, or nil if it was closed on purpose, and
+// close closes the connection.
+type session struct {
+	publish  func(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	confirms <-chan amqp.Confirmation
+	returns  <-chan amqp.Return
+	closed   <-chan *amqp.Error
+	close    func() error
+}
+
+func NewRabbitMQ(cfg config.RabbitMQ) (*RabbitMQ, error) {
+	if err := checkRoutingKey(cfg.RoutingKey); err != nil {
+		return nil, err
+	}
+
+	r := &RabbitMQ{
+		url:            cfg.URL,
+		exchange:       cfg.Exchange,
+		queue:          cfg.Queue,
+		routingKey:     cfg.RoutingKey,
+		queueKeys:      cfg.QueueKeys,
+		bindings:       cfg.Bindings,
+		maxPriority:    cfg.MaxPriority,
+		confirmTimeout: cfg.ConfirmTimeout,
+		minDelay:       minReconnectDelay,
+		maxDelay:       maxReconnectDelay,
+		done:           make(chan struct{}),
+	}
+	if r.confirmTimeout <= 0 {
+		r.confirmTimeout = defaultConfirmTimeout
+	}
+	r.dial = r.open
+
+	if err := r.start(); err != nil {
+		return nil, err
+	}
+	return r, nil
 }
 
-func NewRabbitMQ(url, exchange, queue string) (*RabbitMQ, error) {
-	conn, err := amqp.Dial(url)
+// start connects, then watches the connection in the background.
+func (r *RabbitMQ) start() error {
+	closed, err := r.connect()
+	if err != nil {
+		return err
+	}
+	go r.watch(closed)
+	return nil
+}
+
+// connect opens a session and makes it current, unless Close was called
+// meanwhile. The returned channel receives the error closing the
+// session.
+func (r *RabbitMQ) connect() (<-chan *amqp.Error, error) {
+	s, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state == StateClosed {
+		s.close()
+		return nil, ErrDisconnected
+	}
+	r.session = s
+	r.state = StateConnected
+	return s.closed, nil
+}
+
+// open dials the broker, opens a channel in confirm mode and declares
+// the topology.
+func (r *RabbitMQ) open() (*session, error) {
+	conn, err := amqp.Dial(r.url)
 	if err != nil {
 		return nil, err
 	}
 
 	channel, err := conn.Channel()
+	if err == nil {
+		err = r.declare(channel)
+	}
+	if err == nil {
+		err = channel.Confirm(false)
+	}
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
+	closed := make(chan *amqp.Error, 2)
+	conn.NotifyClose(forward(closed))
+	channel.NotifyClose(forward(closed))
+
+	return &session{
+		publish:  channel.Publish,
+		confirms: channel.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  channel.NotifyReturn(make(chan amqp.Return, 1)),
+		closed:   closed,
+		close: func() error {
+			if conn.IsClosed() {
+				return nil
+			}
+			return conn.Close()
+		},
+	}, nil
+}
+
+// forward returns a channel for NotifyClose that passes on its error to
+// closed, or nil if it was closed on purpose.
+func forward(closed chan<- *amqp.Error) chan *amqp.Error {
+	notify := make(chan *amqp.Error, 1)
+	go func() {
+		closed <- <-notify
+	}()
+	return notify
+}
+
+// topology returns the queues to declare and the keys binding them to
+// the exchange. Without a routing key template, the main queue is bound
+// with its own name, which is then the routing key of every workflow.
+// With one, it is bound with its queue keys or, failing those and further
+// bindings, with "#" to keep receiving every workflow. Left with no keys,
+// it is not declared, so that workflows matching no binding are
+// unroutable.
+func (r *RabbitMQ) topology() []config.Binding {
+	keys := r.queueKeys
+	switch {
+	case r.routingKey == "":
+		keys = []string{r.queue}
+	case len(keys) == 0 && len(r.bindings) == 0:
+		keys = []string{"#"}
+	}
+
+	if len(keys) == 0 {
+		return r.bindings
+	}
+	return append([]config.Binding{{Queue: r.queue, Keys: keys}}, r.bindings...)
+}
+
+// queueArguments returns the arguments every queue is declared with.
+// RabbitMQ refuses to redeclare a queue with other arguments, so changing
+// them requires deleting the queue first.
+func (r *RabbitMQ) queueArguments() amqp.Table {
+	if r.maxPriority == 0 {
+		return nil
+	}
+	return amqp.Table{"x-max-priority": int32(r.maxPriority)}
+}
+
+// declare sets up the exchange, the queues and the bindings between
+// them.
+func (r *RabbitMQ) declare(channel *amqp.Channel) error {
 	// Declare exchange
-	err = channel.ExchangeDeclare(
-		exchange,
+	err := channel.ExchangeDeclare(
+		r.exchange,
 		"topic",
 		true,  // durable
 		false, // auto-deleted
@@ -37,66 +249,232 @@ func NewRabbitMQ(url, exchange, queue string) (*RabbitMQ, error) {
 		nil,   // arguments
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Declare queue
-	_, err = channel.QueueDeclare(
-		queue,
-		true,  // durable
-		false, // delete when unused
-		false, // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
-	if err != nil {
-		return nil, err
+	for _, binding := range r.topology() {
+		// Declare queue
+		_, err = channel.QueueDeclare(
+			binding.Queue,
+			true,  // durable
+			false, // delete when unused
+			false, // exclusive
+			false, // no-wait
+			r.queueArguments(),
+		)
+		if err != nil {
+			return err
+		}
+
+		// Bind queue to exchange
+		for _, key := range binding.Keys {
+			err = channel.QueueBind(
+				binding.Queue,
+				key,
+				r.exchange,
+				false,
+				nil,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// watch reconnects whenever the connection or channel closes, until
+// Close is called.
+func (r *RabbitMQ) watch(closed <-chan *amqp.Error) {
+	for {
+		select {
+		case <-r.done:
+			return
+		case err := <-closed:
+			if err != nil {
+				log.Printf("WARN: rabbitmq: connection lost: %v", err)
+			}
+		}
+
+		// Start afresh even if only the channel closed, so that nothing
+		// is left listening on the old connection
+		r.mu.Lock()
+		if r.state == StateClosed {
+			r.mu.Unlock()
+			return
+		}
+		r.state = StateReconnecting
+		r.session.close()
+		r.session = nil
+		r.mu.Unlock()
+
+		closed = r.reconnect()
+		if closed == nil {
+			return
+		}
+		log.Printf("INFO: rabbitmq: reconnected")
 	}
+}
 
-	// Bind queue to exchange
-	err = channel.QueueBind(
-		queue,
-		queue,
-		exchange,
-		false,
-		nil,
-	)
-	if err != nil {
-		return nil, err
+// reconnect retries connect with jittered exponential backoff. It
+// returns nil if Close is called first.
+func (r *RabbitMQ) reconnect() <-chan *amqp.Error {
+	delay := r.minDelay
+	for attempt := 1; ; attempt++ {
+		// Wait between half and all of the delay
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-r.done:
+			return nil
+		case <-time.After(wait):
+		}
+
+		closed, err := r.connect()
+		if err == nil {
+			return closed
+		}
+		log.Printf("WARN: rabbitmq: reconnection attempt %d failed: %v", attempt, err)
+
+		delay *= 2
+		if delay > r.maxDelay {
+			delay = r.maxDelay
+		}
 	}
+}
 
-	return &RabbitMQ{
-		conn:     conn,
-		channel:  channel,
-		exchange: exchange,
-		queue:    queue,
-	}, nil
+// State returns StateConnected, StateReconnecting or StateClosed.
+func (r *RabbitMQ) State() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.state
 }
 
-func (r *RabbitMQ) PublishWorkflow(workflow *models.Workflow) error {
-	body, err := json.Marshal(workflow)
+// PublishWorkflow publishes one of the workflows of a stored webhook.
+func (r *RabbitMQ) PublishWorkflow(doc *models.WebhookDoc, workflow *models.Workflow) error {
+	msg, err := publishing(doc, workflow)
 	if err != nil {
 		return err
 	}
 
-	return r.channel.Publish(
+	r.publishing.Lock()
+	defer r.publishing.Unlock()
+
+	r.mu.RLock()
+	s := r.session
+	r.mu.RUnlock()
+	if s == nil {
+		return ErrDisconnected
+	}
+
+	key := r.queue
+	if r.routingKey != "" {
+		key = routingKey(r.routingKey, workflow)
+	}
+
+	err = s.publish(
 		r.exchange,
-		r.queue,
-		false, // mandatory
+		key,
+		true,  // mandatory
 		false, // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
+		msg,
 	)
+	if err == amqp.ErrClosed {
+		return ErrDisconnected
+	}
+	if err != nil {
+		return err
+	}
+	return confirm(s.confirms, s.returns, r.confirmTimeout, func() { s.close() })
+}
+
+// publishing builds the message for a workflow. Its properties and
+// headers identify the webhook, so that consumers can route and dedupe
+// without parsing the body. A webhook updating several refs gives several
+// messages with the same ID, told apart by their ref_name header.
+func publishing(doc *models.WebhookDoc, workflow *models.Workflow) (amqp.Publishing, error) {
+	body, err := json.Marshal(workflow)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+
+	return amqp.Publishing{
+		ContentType:   "application/json",
+		DeliveryMode:  amqp.Persistent,
+		MessageId:     doc.ID,
+		CorrelationId: doc.CorrelationID,
+		Timestamp:     doc.UTC,
+		Type:          doc.Event,
+		AppId:         appID,
+		Priority:      doc.Priority,
+		Expiration:    doc.Expiration,
+		Headers: amqp.Table{
+			"organisation": doc.Organisation,
+			"pipeline":     doc.Pipeline,
+			"provider":     doc.Provider,
+			"ref_name":     workflow.RefName,
+		},
+		Body: body,
+	}, nil
+}
+
+// confirm waits on the confirmations and returns of a channel for the
+// broker to acknowledge the message just published. An unroutable
+// message is returned before it is acknowledged. If no confirmation comes
+// in time, reopen is called to start afresh, as a late confirmation would
+// be taken for that of the next message.
+func confirm(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return, timeout time.Duration, reopen func()) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case ret, ok := <-returns:
+		if !ok {
+			return ErrDisconnected
+		}
+		select {
+		case <-confirms:
+		case <-timer.C:
+			reopen()
+		}
+		return fmt.Errorf("%w: %d %s", ErrUnroutable, ret.ReplyCode, ret.ReplyText)
+
+	case confirmation, ok := <-confirms:
+		if !ok {
+			return ErrDisconnected
+		}
+		select {
+		case ret, ok := <-returns:
+			if ok {
+				return fmt.Errorf("%w: %d %s", ErrUnroutable, ret.ReplyCode, ret.ReplyText)
+			}
+		default:
+		}
+		if !confirmation.Ack {
+			return ErrNacked
+		}
+		return nil
+
+	case <-timer.C:
+		log.Printf("WARN: rabbitmq: no confirmation after %s, reconnecting", timeout)
+		reopen()
+		return ErrConfirmTimeout
+	}
 }
 
 func (r *RabbitMQ) Close() error {
-	if r.channel != nil {
-		r.channel.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state == StateClosed {
+		return nil
 	}
-	if r.conn != nil {
-		return r.conn.Close()
+	r.state = StateClosed
+	close(r.done)
+
+	if r.session == nil {
+		return nil
 	}
-	return nil
+	err := r.session.close()
+	r.session = nil
+	return err
 }
@@ -0,0 +1,381 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"tsuribari/internal/models"
+)
+
+func TestPublishing(t *testing.T) {
+	doc := &models.WebhookDoc{
+		ID:            "8a3a1b1c2f",
+		UTC:           time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC),
+		Organisation:  "demo",
+		Pipeline:      "build",
+		Provider:      "github",
+		Event:         "push",
+		CorrelationID: "72d3162e-cc78-11e3-81ab-4c9367dc0958",
+		Priority:      5,
+		Expiration:    "60000",
+	}
+	workflow := &models.Workflow{ID: doc.ID, Ref: "abc123", RefName: "refs/heads/main"}
+
+	msg, err := publishing(doc, workflow)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if msg.MessageId != doc.ID || msg.CorrelationId != doc.CorrelationID {
+		t.Errorf("Expected message and correlation IDs of the webhook, got %s %s", msg.MessageId, msg.CorrelationId)
+	}
+	if msg.DeliveryMode != amqp.Persistent {
+		t.Errorf("Expected persistent delivery, got %d", msg.DeliveryMode)
+	}
+	if !msg.Timestamp.Equal(doc.UTC) || msg.Type != "push" || msg.AppId != "tsuribari" {
+		t.Errorf("Expected timestamp, type push and app tsuribari, got %s %s %s", msg.Timestamp, msg.Type, msg.AppId)
+	}
+	if msg.Priority != 5 || msg.Expiration != "60000" {
+		t.Errorf("Expected priority 5 and expiration 60000, got %d %s", msg.Priority, msg.Expiration)
+	}
+
+	for name, expected := range map[string]string{
+		"organisation": "demo",
+		"pipeline":     "build",
+		"provider":     "github",
+		"ref_name":     "refs/heads/main",
+	} {
+		if msg.Headers[name] != expected {
+			t.Errorf("Expected header %s '%s', got '%v'", name, expected, msg.Headers[name])
+		}
+	}
+	if err := msg.Headers.Validate(); err != nil {
+		t.Errorf("Expected valid headers, got %v", err)
+	}
+
+	var body models.Workflow
+	if err := json.Unmarshal(msg.Body, &body); err != nil || body.Ref != "abc123" {
+		t.Errorf("Expected workflow body, got %s (%v)", msg.Body, err)
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	unroutable := amqp.Return{ReplyCode: 312, ReplyText: "NO_ROUTE"}
+
+	tests := []struct {
+		name         string
+		confirmation *amqp.Confirmation
+		ret          *amqp.Return
+		closed       bool
+		expected     error
+		reopened     bool
+	}{
+		{"Ack", &amqp.Confirmation{DeliveryTag: 1, Ack: true}, nil, false, nil, false},
+		{"Nack", &amqp.Confirmation{DeliveryTag: 1}, nil, false, ErrNacked, false},
+		{"Returned then acked", &amqp.Confirmation{DeliveryTag: 1, Ack: true}, &unroutable, false, ErrUnroutable, false},
+		{"Returned without ack", nil, &unroutable, false, ErrUnroutable, true},
+		{"Timeout", nil, nil, false, ErrConfirmTimeout, true},
+		{"Channel closed", nil, nil, true, ErrDisconnected, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			confirms := make(chan amqp.Confirmation, 1)
+			returns := make(chan amqp.Return, 1)
+			if tt.ret != nil {
+				returns <- *tt.ret
+			}
+			if tt.confirmation != nil {
+				confirms <- *tt.confirmation
+			}
+			if tt.closed {
+				close(confirms)
+				close(returns)
+			}
+
+			reopened := false
+			err := confirm(confirms, returns, 10*time.Millisecond, func() { reopened = true })
+
+			if !errors.Is(err, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, err)
+			}
+			if reopened != tt.reopened {
+				t.Errorf("Expected reopened %v, got %v", tt.reopened, reopened)
+			}
+			if tt.ret != nil && err != nil && err.Error() != "rabbitmq: unroutable: 312 NO_ROUTE" {
+				t.Errorf("Expected broker reply in error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestConfirm_ReturnBeforeLateAck(t *testing.T) {
+	confirms := make(chan amqp.Confirmation)
+	returns := make(chan amqp.Return, 1)
+	returns <- amqp.Return{ReplyCode: 312, ReplyText: "NO_ROUTE"}
+
+	// The ack following the return is consumed, so that it is not taken
+	// for that of the next message
+	go func() {
+		confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	}()
+
+	reopened := false
+	err := confirm(confirms, returns, time.Second, func() { reopened = true })
+	if !errors.Is(err, ErrUnroutable) {
+		t.Errorf("Expected ErrUnroutable, got %v", err)
+	}
+	if reopened {
+		t.Error("Expected the channel to be kept once the ack came")
+	}
+
+	select {
+	case confirmation := <-confirms:
+		t.Errorf("Expected the ack to be consumed, got %+v", confirmation)
+	default:
+	}
+}
+
+// Fake broker, handing out sessions that acknowledge every message,
+// failing to while err is set, and holding dials while gate is open
+type fakeBroker struct {
+	mu       sync.Mutex
+	err      error
+	gate     chan struct{}
+	dials    int
+	sessions []*fakeSession
+}
+
+type fakeSession struct {
+	confirms chan amqp.Confirmation
+	closed   chan *amqp.Error
+
+	mu       sync.Mutex
+	isClosed bool
+}
+
+func (b *fakeBroker) dial() (*session, error) {
+	b.mu.Lock()
+	b.dials++
+	gate := b.gate
+	b.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	fs := &fakeSession{
+		confirms: make(chan amqp.Confirmation, 1),
+		closed:   make(chan *amqp.Error, 1),
+	}
+	b.sessions = append(b.sessions, fs)
+	return &session{
+		publish: func(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+			fs.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+			return nil
+		},
+		confirms: fs.confirms,
+		returns:  make(chan amqp.Return),
+		closed:   fs.closed,
+		close: func() error {
+			fs.mu.Lock()
+			defer fs.mu.Unlock()
+			fs.isClosed = true
+			return nil
+		},
+	}, nil
+}
+
+func (b *fakeBroker) setErr(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+func (b *fakeBroker) dialCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dials
+}
+
+// session returns the nth session handed out, or nil.
+func (b *fakeBroker) session(n int) *fakeSession {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n >= len(b.sessions) {
+		return nil
+	}
+	return b.sessions[n]
+}
+
+func (fs *fakeSession) wasClosed() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.isClosed
+}
+
+func newTestRabbitMQ(broker *fakeBroker) *RabbitMQ {
+	return &RabbitMQ{
+		exchange:       "koans.topic",
+		queue:          "koans.workflow",
+		confirmTimeout: time.Second,
+		dial:           broker.dial,
+		minDelay:       time.Millisecond,
+		maxDelay:       5 * time.Millisecond,
+		done:           make(chan struct{}),
+	}
+}
+
+// eventually fails the test if cond does not hold within a second.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("Expected %s", what)
+}
+
+func publishTest(r *RabbitMQ) error {
+	return r.PublishWorkflow(&models.WebhookDoc{ID: "a"}, &models.Workflow{ID: "a", RefName: "refs/heads/main"})
+}
+
+func TestRabbitMQ_StartFails(t *testing.T) {
+	broker := &fakeBroker{err: errors.New("connection refused")}
+	r := newTestRabbitMQ(broker)
+
+	if err := r.start(); err == nil {
+		t.Fatal("Expected error when the broker is unreachable, got nil")
+	}
+	if err := publishTest(r); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("Expected ErrDisconnected, got %v", err)
+	}
+}
+
+func TestRabbitMQ_Reconnects(t *testing.T) {
+	broker := &fakeBroker{}
+	r := newTestRabbitMQ(broker)
+	if err := r.start(); err != nil {
+		t.Fatalf("Expected to connect, got %v", err)
+	}
+	defer r.Close()
+
+	if r.State() != StateConnected {
+		t.Errorf("Expected state connected, got %s", r.State())
+	}
+	if err := publishTest(r); err != nil {
+		t.Errorf("Expected message to be published, got %v", err)
+	}
+
+	// Keep the broker down after the connection is lost
+	broker.setErr(errors.New("connection refused"))
+	broker.session(0).closed <- &amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED"}
+
+	eventually(t, "state reconnecting", func() bool { return r.State() == StateReconnecting })
+	if err := publishTest(r); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("Expected ErrDisconnected while reconnecting, got %v", err)
+	}
+	if !broker.session(0).wasClosed() {
+		t.Error("Expected the lost session to be closed")
+	}
+	eventually(t, "failed reconnection attempts", func() bool { return broker.dialCount() >= 3 })
+
+	broker.setErr(nil)
+	eventually(t, "state connected", func() bool { return r.State() == StateConnected })
+	if broker.session(1) == nil {
+		t.Fatal("Expected a new session")
+	}
+	if err := publishTest(r); err != nil {
+		t.Errorf("Expected message to be published after reconnecting, got %v", err)
+	}
+}
+
+func TestRabbitMQ_ReconnectsAfterGracefulClose(t *testing.T) {
+	broker := &fakeBroker{}
+	r := newTestRabbitMQ(broker)
+	if err := r.start(); err != nil {
+		t.Fatalf("Expected to connect, got %v", err)
+	}
+	defer r.Close()
+
+	// A channel closed on purpose, as after a confirmation timeout
+	broker.session(0).closed <- nil
+
+	eventually(t, "a new session", func() bool { return broker.session(1) != nil && r.State() == StateConnected })
+}
+
+func TestRabbitMQ_CloseDuringReconnect(t *testing.T) {
+	broker := &fakeBroker{}
+	r := newTestRabbitMQ(broker)
+	if err := r.start(); err != nil {
+		t.Fatalf("Expected to connect, got %v", err)
+	}
+
+	broker.setErr(errors.New("connection refused"))
+	broker.session(0).closed <- &amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED"}
+	eventually(t, "state reconnecting", func() bool { return r.State() == StateReconnecting })
+
+	if err := r.Close(); err != nil {
+		t.Errorf("Expected no error closing, got %v", err)
+	}
+	if r.State() != StateClosed {
+		t.Errorf("Expected state closed, got %s", r.State())
+	}
+
+	// No further attempts once closed, even if the broker comes back
+	broker.setErr(nil)
+	time.Sleep(20 * time.Millisecond)
+	dials := broker.dialCount()
+	time.Sleep(20 * time.Millisecond)
+	if broker.dialCount() != dials {
+		t.Errorf("Expected no reconnection attempt after closing, got %d more", broker.dialCount()-dials)
+	}
+	if r.State() != StateClosed {
+		t.Errorf("Expected state to stay closed, got %s", r.State())
+	}
+	if err := publishTest(r); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("Expected ErrDisconnected once closed, got %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Expected closing twice to succeed, got %v", err)
+	}
+}
+
+func TestRabbitMQ_CloseWhileDialling(t *testing.T) {
+	broker := &fakeBroker{}
+	r := newTestRabbitMQ(broker)
+	if err := r.start(); err != nil {
+		t.Fatalf("Expected to connect, got %v", err)
+	}
+
+	// Hold the next dial until Close is called
+	gate := make(chan struct{})
+	broker.mu.Lock()
+	broker.gate = gate
+	broker.mu.Unlock()
+
+	broker.session(0).closed <- &amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED"}
+	eventually(t, "a reconnection attempt", func() bool { return broker.dialCount() == 2 })
+
+	r.Close()
+	close(gate)
+
+	eventually(t, "the late session to be closed", func() bool {
+		late := broker.session(1)
+		return late != nil && late.wasClosed()
+	})
+	if r.State() != StateClosed {
+		t.Errorf("Expected state closed, got %s", r.State())
+	}
+}
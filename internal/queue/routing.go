@@ -0,0 +1,56 @@
+package queue
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"tsuribari/internal/models"
+)
+
+// placeholders are the workflow fields a routing key template may use.
+var placeholders = map[string]func(*models.Workflow) string{
+	"org":      func(w *models.Workflow) string { return w.Org },
+	"pipeline": func(w *models.Workflow) string { return w.Pipeline },
+	"event":    func(w *models.Workflow) string { return w.Event },
+	"action":   func(w *models.Workflow) string { return w.Action },
+	"ref_type": func(w *models.Workflow) string { return w.RefType },
+	"branch":   func(w *models.Workflow) string { return shortRefName(w.RefName) },
+}
+
+var placeholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// checkRoutingKey reports the first unknown placeholder of a template.
+func checkRoutingKey(template string) error {
+	for _, match := range placeholder.FindAllString(template, -1) {
+		if _, ok := placeholders[match[1:len(match)-1]]; !ok {
+			return fmt.Errorf("rabbitmq.routing_key: unknown placeholder %s", match)
+		}
+	}
+	return nil
+}
+
+// routingKey renders a template checked by checkRoutingKey. Each value is
+// kept to a single word of the key, with dots replaced by underscores,
+// and empty values are written as "_", so that "*" in a binding matches
+// any of them.
+func routingKey(template string, workflow *models.Workflow) string {
+	return placeholder.ReplaceAllStringFunc(template, func(match string) string {
+		value := placeholders[match[1:len(match)-1]](workflow)
+		if value == "" {
+			return "_"
+		}
+		return strings.ReplaceAll(value, ".", "_")
+	})
+}
+
+// shortRefName strips refs/heads/ or refs/tags/, or failing those refs/,
+// from a ref name.
+func shortRefName(refName string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/"} {
+		if strings.HasPrefix(refName, prefix) {
+			return strings.TrimPrefix(refName, prefix)
+		}
+	}
+	return refName
+}
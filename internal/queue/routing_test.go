@@ -0,0 +1,125 @@
+package queue
+
+import (
+	"reflect"
+	"testing"
+
+	"tsuribari/internal/config"
+	"tsuribari/internal/models"
+)
+
+func TestRoutingKey(t *testing.T) {
+	const template = "{org}.{pipeline}.{event}.{branch}"
+
+	tests := []struct {
+		name     string
+		workflow models.Workflow
+		expected string
+	}{
+		{
+			name:     "Branch push",
+			workflow: models.Workflow{Org: "skunkwerks", Pipeline: "build", Event: "push", RefName: "refs/heads/main"},
+			expected: "skunkwerks.build.push.main",
+		},
+		{
+			name:     "Tag with dots",
+			workflow: models.Workflow{Org: "skunkwerks", Pipeline: "release", Event: "Tag Push Hook", RefName: "refs/tags/v1.2.0"},
+			expected: "skunkwerks.release.Tag Push Hook.v1_2_0",
+		},
+		{
+			name:     "Pull request without pipeline",
+			workflow: models.Workflow{Org: "skunkwerks", Event: "pull_request", RefName: "refs/pull/42/head"},
+			expected: "skunkwerks._.pull_request.pull/42/head",
+		},
+		{
+			name:     "Nested branch without event",
+			workflow: models.Workflow{Org: "skunkwerks", Pipeline: "build", RefName: "refs/heads/feature/login"},
+			expected: "skunkwerks.build._.feature/login",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := routingKey(template, &tt.workflow); got != tt.expected {
+				t.Errorf("Expected routing key '%s', got '%s'", tt.expected, got)
+			}
+		})
+	}
+
+	workflow := models.Workflow{Action: models.ActionDelete, RefType: models.RefTypeTag}
+	if got := routingKey("workflows.{action}.{ref_type}", &workflow); got != "workflows.delete.tag" {
+		t.Errorf("Expected routing key 'workflows.delete.tag', got '%s'", got)
+	}
+}
+
+func TestCheckRoutingKey(t *testing.T) {
+	for template, valid := range map[string]bool{
+		"{org}.{pipeline}.{event}.{branch}": true,
+		"workflows.{action}.{ref_type}":     true,
+		"workflows":                         true,
+		"{org}.{repository}":                false,
+		"{}":                                false,
+	} {
+		if err := checkRoutingKey(template); (err == nil) != valid {
+			t.Errorf("Expected %q valid to be %v, got %v", template, valid, err)
+		}
+	}
+}
+
+func TestTopology(t *testing.T) {
+	release := config.Binding{Queue: "koans.release", Keys: []string{"*.release.#"}}
+
+	tests := []struct {
+		name     string
+		r        *RabbitMQ
+		expected []config.Binding
+	}{
+		{
+			name:     "Queue name as key",
+			r:        &RabbitMQ{queue: "koans.workflow"},
+			expected: []config.Binding{{Queue: "koans.workflow", Keys: []string{"koans.workflow"}}},
+		},
+		{
+			name:     "Template without bindings",
+			r:        &RabbitMQ{queue: "koans.workflow", routingKey: "{org}.{pipeline}"},
+			expected: []config.Binding{{Queue: "koans.workflow", Keys: []string{"#"}}},
+		},
+		{
+			name:     "Bindings replace the main queue",
+			r:        &RabbitMQ{queue: "koans.workflow", routingKey: "{org}.{pipeline}", bindings: []config.Binding{release}},
+			expected: []config.Binding{release},
+		},
+		{
+			name: "Queue keys",
+			r: &RabbitMQ{
+				queue:      "koans.workflow",
+				routingKey: "{org}.{pipeline}",
+				queueKeys:  []string{"*.build"},
+				bindings:   []config.Binding{release},
+			},
+			expected: []config.Binding{{Queue: "koans.workflow", Keys: []string{"*.build"}}, release},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.topology(); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestQueueArguments(t *testing.T) {
+	if args := (&RabbitMQ{}).queueArguments(); args != nil {
+		t.Errorf("Expected no arguments without max priority, got %v", args)
+	}
+
+	args := (&RabbitMQ{maxPriority: 10}).queueArguments()
+	if args["x-max-priority"] != int32(10) {
+		t.Errorf("Expected x-max-priority 10, got %v", args)
+	}
+	if err := args.Validate(); err != nil {
+		t.Errorf("Expected valid arguments, got %v", err)
+	}
+}
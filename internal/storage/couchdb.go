@@ -2,12 +2,8 @@ package storage
 
 import (
 	"context"
-	"crypto/sha1"
-	"encoding/hex"
-	"encoding/json"
 	"log"
 	"net/http"
-	"time"
 
 	_ "github.com/go-kivik/couchdb/v3"
 	"github.com/go-kivik/kivik/v3"
@@ -15,6 +11,22 @@ import (
 	"tsuribari/internal/models"
 )
 
+// outboxDesign holds the view listing webhooks whose workflows are still
+// to be published.
+const outboxDesign = "_design/outbox"
+
+const pendingMap = `function (doc) { if (doc.publish_status === "pending") { emit(doc._id, null); } }`
+
+type designDoc struct {
+	Rev      string          `json:"_rev,omitempty"`
+	Language string          `json:"language"`
+	Views    map[string]view `json:"views"`
+}
+
+type view struct {
+	Map string `json:"map"`
+}
+
 type CouchDB struct {
 	client *kivik.Client
 	db     *kivik.DB
@@ -28,43 +40,89 @@ func NewCouchDB(url, database string) (*CouchDB, error) {
 
 	db := client.DB(context.Background(), database)
 
-	return &CouchDB{
+	c := &CouchDB{
 		client: client,
 		db:     db,
-	}, nil
+	}
+	if err := c.ensureViews(); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
-func (c *CouchDB) StoreWebhook(headers map[string]string, body []byte) (*models.WebhookDoc, error) {
-	// Generate document ID from body hash
-	hash := sha1.Sum(body)
-	docID := hex.EncodeToString(hash[:])
+// ensureViews creates the outbox design document, or brings it up to
+// date.
+func (c *CouchDB) ensureViews() error {
+	ctx := context.Background()
 
-	// Parse JSON body
-	var bodyMap map[string]interface{}
-	if err := json.Unmarshal(body, &bodyMap); err != nil {
-		return nil, err
+	var design designDoc
+	err := c.db.Get(ctx, outboxDesign).ScanDoc(&design)
+	if err != nil && kivik.StatusCode(err) != http.StatusNotFound {
+		return err
 	}
-
-	doc := &models.WebhookDoc{
-		ID:      docID,
-		UTC:     time.Now().UTC(),
-		Headers: headers,
-		Body:    bodyMap,
+	if design.Views["pending"].Map == pendingMap {
+		return nil
 	}
 
-	_, err := c.db.Put(context.Background(), docID, doc)
+	design.Language = "javascript"
+	design.Views = map[string]view{"pending": {Map: pendingMap}}
+	_, err = c.db.Put(ctx, outboxDesign, design)
+	return err
+}
+
+func (c *CouchDB) StoreWebhook(doc *models.WebhookDoc) error {
+	rev, err := c.db.Put(context.Background(), doc.ID, doc)
 	if err != nil {
-		// for 409 conflicts, return the document anyway since it
+		// for 409 conflicts, accept the document anyway since it
 		// already exists with the correct checksum
 		if kivik.StatusCode(err) == http.StatusConflict {
-			log.Printf("409 conflict from webhook with doc.id: %s", docID)
-			return doc, nil
+			log.Printf("409 conflict from webhook with doc.id: %s", doc.ID)
+			return nil
 		}
 
 		// Log other errors for debugging
 		log.Printf("ERROR: couchdb: %v (status: %d)", err, kivik.StatusCode(err))
+		return err
+	}
+
+	doc.Rev = rev
+	return nil
+}
+
+// GetWebhook reads a stored webhook, with its current revision.
+func (c *CouchDB) GetWebhook(id string) (*models.WebhookDoc, error) {
+	var doc models.WebhookDoc
+	if err := c.db.Get(context.Background(), id).ScanDoc(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// UpdateWebhook writes back a webhook read with GetWebhook. It fails with
+// a conflict if the webhook changed in between.
+func (c *CouchDB) UpdateWebhook(doc *models.WebhookDoc) error {
+	rev, err := c.db.Put(context.Background(), doc.ID, doc)
+	if err != nil {
+		log.Printf("ERROR: couchdb: %v (status: %d)", err, kivik.StatusCode(err))
+		return err
+	}
+
+	doc.Rev = rev
+	return nil
+}
+
+// PendingWebhooks lists the IDs of webhooks whose workflows are still to
+// be published.
+func (c *CouchDB) PendingWebhooks() ([]string, error) {
+	rows, err := c.db.Query(context.Background(), outboxDesign, "pending")
+	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return doc, nil
+	var ids []string
+	for rows.Next() {
+		ids = append(ids, rows.ID())
+	}
+	return ids, rows.Err()
 }